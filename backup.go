@@ -0,0 +1,477 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/armon/consul-api"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//BackupKV is a key of a legacy export file, which stores every definition
+//as the JSON value of its key.
+type BackupKV struct {
+	Key, Value string
+}
+
+//ExportVersion is the version of the export format written by
+//BackupExternalServicesToYAML. Files without a version are read as legacy
+//lists of BackupKV.
+const ExportVersion = 2
+
+//ExportFile is the versioned export format, where every definition is a
+//YAML mapping that can be reviewed and edited by hand.
+type ExportFile struct {
+	Version  int                `yaml:"version"`
+	Services []*ExportedService `yaml:"services"`
+}
+
+//ExportedService is a definition of an export file.
+type ExportedService struct {
+	Node       string                    `yaml:"node"`
+	Service    string                    `yaml:"service"`
+	Definition ExternalServiceDefinition `yaml:",inline"`
+}
+
+//restoreValue returns the value to store for a key of an export file of
+//version.
+func restoreValue(a BackupKV, version int) ([]byte, error) {
+	if version < ExportVersion {
+		return []byte(a.Value), nil
+	}
+	if _, _, ok := parseServiceKey(a.Key); !ok {
+		return nil, fmt.Errorf("node and service are required")
+	}
+	var esd ExternalServiceDefinition
+	if err := json.Unmarshal([]byte(a.Value), &esd); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&esd)
+}
+
+//FileError is an error reading, decoding, encoding or writing a backup file.
+type FileError struct {
+	Op   string
+	File string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.File, e.Err)
+}
+
+//KeyError is an error restoring a key of a backup file.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("restoring %s: %v", e.Key, e.Err)
+}
+
+//Filter selects the external services exported or restored. Empty fields
+//match every service.
+type Filter struct {
+	Node string
+	//Service is a shell pattern as used by path.Match.
+	Service string
+	Tag     string
+}
+
+func (f Filter) empty() bool {
+	return f.Node == "" && f.Service == "" && f.Tag == ""
+}
+
+func (f Filter) check() error {
+	if _, err := path.Match(f.Service, ""); err != nil {
+		return fmt.Errorf("invalid service pattern %q: %v", f.Service, err)
+	}
+	return nil
+}
+
+//Match reports whether the service of node defined by esd is selected by f.
+func (f Filter) Match(node, service string, esd *ExternalServiceDefinition) bool {
+	if f.Node != "" && node != f.Node {
+		return false
+	}
+	if f.Service != "" {
+		if ok, _ := path.Match(f.Service, service); !ok {
+			return false
+		}
+	}
+	if f.Tag != "" {
+		for _, t := range esd.Tags {
+			if t == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+//BackupOptions controls what is written to a backup file.
+type BackupOptions struct {
+	//Format is one of the export formats, chosen from the extension of the
+	//file if empty.
+	Format string
+	Filter Filter
+	//Encryption encrypts the file if set.
+	Encryption *Encryption
+	//Perm are the permissions of the file, 0600 if zero.
+	Perm os.FileMode
+}
+
+//Restore modes, deciding what happens to definitions that already exist.
+const (
+	RestoreOverwrite    = "overwrite"
+	RestoreSkipExisting = "skip-existing"
+	RestoreFailIfExists = "fail-if-exists"
+)
+
+//RestoreOptions controls how a backup file is restored.
+type RestoreOptions struct {
+	//Format is one of the export formats, chosen from the extension of the
+	//file if empty.
+	Format string
+	//Mode is one of the restore modes, RestoreOverwrite if empty.
+	Mode string
+	//Filter selects the definitions of the file restored.
+	Filter Filter
+	//Encryption decrypts the file if it is encrypted.
+	Encryption *Encryption
+	//ContinueOnError writes the keys one by one, restoring every key it can,
+	//instead of restoring all of them or none.
+	ContinueOnError bool
+	//From is empty for export files or FromConsulService for consul agent
+	//service definitions, converted into definitions of Node.
+	From string
+	Node string
+}
+
+//RestoreSummary reports what was and wasn't restored from a backup file.
+//Keys outside the ExternalServices tree, such as the watcher locks found in
+//old backups, are Skipped. Keys not selected by the filter are Excluded. Keys
+//already defined are Existing when skipped by
+//RestoreSkipExisting. Keys left untouched because the restore failed as a
+//whole are NotAttempted. Fields of converted consul service definitions that
+//were left out are Unmapped.
+type RestoreSummary struct {
+	Restored     []string
+	Skipped      []string
+	Existing     []string
+	Excluded     []string
+	Failed       []*KeyError
+	NotAttempted []string
+	Unmapped     []UnmappedField
+}
+
+//RestoreError is returned when some keys of a backup file could not be
+//restored. Summary tells which ones.
+type RestoreError struct {
+	File    string
+	Summary *RestoreSummary
+}
+
+func (e *RestoreError) Error() string {
+	s := e.Summary
+	total := len(s.Restored) + len(s.Skipped) + len(s.Existing) + len(s.Excluded) + len(s.Failed) + len(s.NotAttempted)
+	msg := fmt.Sprintf("restoring %s: %d of %d keys not restored", e.File, len(s.Failed)+len(s.NotAttempted), total)
+	if len(s.Failed) > 0 {
+		msg += ": " + s.Failed[0].Error()
+		if len(s.Failed) > 1 {
+			msg += fmt.Sprintf(" (and %d more)", len(s.Failed)-1)
+		}
+	}
+	return msg
+}
+
+//BackupExternalServicesToYAML writes every external service definition to
+//fileName in the current export format.
+func BackupExternalServicesToYAML(client *Client, fileName string) error {
+	return BackupExternalServices(client, fileName, nil)
+}
+
+//BackupExternalServices writes the external service definitions selected by
+//opts to fileName in the current version of the export format. The file is
+//replaced atomically and is only readable by its owner unless opts.Perm says
+//otherwise.
+func BackupExternalServices(client *Client, fileName string, opts *BackupOptions) error {
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	format, err := resolveFormat(fileName, opts.Format)
+	if err != nil {
+		return err
+	}
+	ex, err := exportExternalServices(client, opts.Filter)
+	if err != nil {
+		return err
+	}
+	d, err := encodeExport(ex, format)
+	if err != nil {
+		return &FileError{Op: "encoding", File: fileName, Err: err}
+	}
+	if opts.Encryption != nil {
+		if d, err = opts.Encryption.Encrypt(d); err != nil {
+			return &FileError{Op: "encrypting", File: fileName, Err: err}
+		}
+	}
+	perm := opts.Perm
+	if perm == 0 {
+		perm = 0600
+	}
+	if err := writeFileAtomic(fileName, d, perm); err != nil {
+		return &FileError{Op: "writing", File: fileName, Err: err}
+	}
+	return nil
+}
+
+//exportExternalServices returns the definitions selected by filter.
+func exportExternalServices(client *Client, filter Filter) (*ExportFile, error) {
+	if err := filter.check(); err != nil {
+		return nil, err
+	}
+	prefix := "ExternalServices/"
+	if filter.Node != "" {
+		prefix += filter.Node + "/"
+	}
+	kvp, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, fmt.Errorf("listing external services: %v", err)
+	}
+	ex := &ExportFile{Version: ExportVersion}
+	for _, a := range kvp {
+		node, service, ok := parseServiceKey(a.Key)
+		if !ok {
+			continue
+		}
+		es := &ExportedService{Node: node, Service: service}
+		if err := json.Unmarshal(a.Value, &es.Definition); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", a.Key, err)
+		}
+		if !filter.Match(node, service, &es.Definition) {
+			continue
+		}
+		ex.Services = append(ex.Services, es)
+	}
+	return ex, nil
+}
+
+//writeFileAtomic writes data to a temporary file of the directory of
+//fileName and renames it, so readers see either the old or the new file.
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fileName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+//RestoreExternalServicesFromYAML writes every definition of fileName to
+//consul, or none if any of them fails.
+func RestoreExternalServicesFromYAML(client *Client, fileName string) error {
+	_, err := RestoreExternalServices(client, fileName, nil)
+	return err
+}
+
+//RestoreExternalServices writes the definitions of fileName, in any export
+//format or the legacy one, to consul and reports the outcome of every key.
+//The definitions of versioned files must pass validation to be restored.
+//Unless opts.ContinueOnError is set every key is written with check-and-set
+//in consul transactions, so either the whole file is restored or nothing is.
+//Files too large for one transaction are written in several, and the keys
+//written by the earlier ones are seen by watchers until they are rolled back
+//after a later one fails. If any key is not restored the summary is
+//returned together with a *RestoreError.
+func RestoreExternalServices(client *Client, fileName string, opts *RestoreOptions) (*RestoreSummary, error) {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	mode := opts.Mode
+	switch mode {
+	case "":
+		mode = RestoreOverwrite
+	case RestoreOverwrite, RestoreSkipExisting, RestoreFailIfExists:
+	default:
+		return nil, fmt.Errorf("unknown restore mode %q, must be %s, %s or %s", mode, RestoreOverwrite, RestoreSkipExisting, RestoreFailIfExists)
+	}
+	format, err := resolveFormat(fileName, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Filter.check(); err != nil {
+		return nil, err
+	}
+	if opts.From != "" && opts.From != FromConsulService {
+		return nil, fmt.Errorf("unknown source %q, must be %s", opts.From, FromConsulService)
+	}
+	vals, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, &FileError{Op: "reading", File: fileName, Err: err}
+	}
+	if vals, err = decryptBackup(vals, opts.Encryption); err != nil {
+		return nil, &FileError{Op: "decrypting", File: fileName, Err: err}
+	}
+	var unmapped []UnmappedField
+	if opts.From == FromConsulService {
+		ex, u, err := ConvertConsulServices(vals, format, opts.Node)
+		if err != nil {
+			return nil, &FileError{Op: "converting", File: fileName, Err: err}
+		}
+		if vals, err = encodeExport(ex, FormatYAML); err != nil {
+			return nil, &FileError{Op: "converting", File: fileName, Err: err}
+		}
+		format, unmapped = FormatYAML, u
+	}
+	kv, version, err := decodeExport(vals, format)
+	if err != nil {
+		return nil, &FileError{Op: "decoding", File: fileName, Err: err}
+	}
+	invalid := make(map[string][]string)
+	if version >= ExportVersion {
+		_, problems := parseDefinitionsFormat(fileName, vals, format)
+		for _, p := range problems {
+			invalid[p.Key] = append(invalid[p.Key], p.Message)
+		}
+	}
+	kvp, _, err := client.KV().List("ExternalServices/", nil)
+	if err != nil {
+		return nil, fmt.Errorf("listing external services: %v", err)
+	}
+	current := make(map[string]*consulapi.KVPair)
+	for _, a := range kvp {
+		current[a.Key] = a
+	}
+
+	summary := &RestoreSummary{Unmapped: unmapped}
+	var writes []*kvWrite
+	seen := make(map[string]bool)
+	for _, a := range kv {
+		if !strings.HasPrefix(a.Key, "ExternalServices/") {
+			summary.Skipped = append(summary.Skipped, a.Key)
+			continue
+		}
+		if !opts.Filter.empty() {
+			node, service, _ := parseServiceKey(a.Key)
+			var esd ExternalServiceDefinition
+			json.Unmarshal([]byte(a.Value), &esd)
+			if !opts.Filter.Match(node, service, &esd) {
+				summary.Excluded = append(summary.Excluded, a.Key)
+				continue
+			}
+		}
+		if seen[a.Key] {
+			summary.Failed = append(summary.Failed, &KeyError{Key: a.Key, Err: fmt.Errorf("duplicate key")})
+			continue
+		}
+		seen[a.Key] = true
+		if msgs := invalid[a.Key]; msgs != nil {
+			summary.Failed = append(summary.Failed, &KeyError{Key: a.Key, Err: ValidationErrors(msgs)})
+			continue
+		}
+		value, err := restoreValue(a, version)
+		if err != nil {
+			summary.Failed = append(summary.Failed, &KeyError{Key: a.Key, Err: err})
+			continue
+		}
+		w := &kvWrite{Key: a.Key, Value: value}
+		if prev := current[a.Key]; prev != nil {
+			if mode == RestoreSkipExisting {
+				summary.Existing = append(summary.Existing, a.Key)
+				continue
+			}
+			if mode == RestoreFailIfExists {
+				summary.Failed = append(summary.Failed, &KeyError{Key: a.Key, Err: fmt.Errorf("already exists")})
+				continue
+			}
+			w.Index, w.Previous = prev.ModifyIndex, prev
+		}
+		writes = append(writes, w)
+	}
+
+	if opts.ContinueOnError {
+		for _, w := range writes {
+			err := writeDefinitions(client, []*kvWrite{w})
+			if _, ok := err.(*TxnError); ok {
+				err = ErrConflict
+			}
+			if err != nil {
+				summary.Failed = append(summary.Failed, &KeyError{Key: w.Key, Err: err})
+				continue
+			}
+			summary.Restored = append(summary.Restored, w.Key)
+		}
+	} else if len(summary.Failed) == 0 {
+		if err := writeDefinitions(client, writes); err != nil {
+			if re, ok := err.(*RollbackError); ok {
+				//Some batches stay committed: report them as restored and the
+				//key that failed, if known, as failed.
+				committed := make(map[string]bool)
+				for _, key := range re.Committed {
+					committed[key] = true
+				}
+				failed := ""
+				if te, ok := re.Err.(*TxnError); ok {
+					failed = te.Key
+				}
+				for _, w := range writes {
+					switch {
+					case committed[w.Key]:
+						summary.Restored = append(summary.Restored, w.Key)
+					case w.Key == failed:
+						summary.Failed = append(summary.Failed, &KeyError{Key: w.Key, Err: re.Err})
+					default:
+						summary.NotAttempted = append(summary.NotAttempted, w.Key)
+					}
+				}
+				return summary, fmt.Errorf("restoring %s: %v", fileName, err)
+			}
+			if te, ok := err.(*TxnError); ok {
+				summary.Failed = append(summary.Failed, &KeyError{Key: te.Key, Err: err})
+			} else {
+				for _, w := range writes {
+					summary.NotAttempted = append(summary.NotAttempted, w.Key)
+				}
+				return summary, fmt.Errorf("restoring %s: %v, nothing restored", fileName, err)
+			}
+		} else {
+			for _, w := range writes {
+				summary.Restored = append(summary.Restored, w.Key)
+			}
+		}
+	}
+	if !opts.ContinueOnError && len(summary.Failed) > 0 {
+		for _, w := range writes {
+			if w.Key != summary.Failed[0].Key {
+				summary.NotAttempted = append(summary.NotAttempted, w.Key)
+			}
+		}
+	}
+
+	if len(summary.Failed) > 0 {
+		return summary, &RestoreError{File: fileName, Summary: summary}
+	}
+	return summary, nil
+}
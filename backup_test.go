@@ -0,0 +1,74 @@
+package consul_externalservice
+
+import (
+	. "github.com/franela/goblin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("backup filters", func() {
+		esd := &ExternalServiceDefinition{Tags: []string{"web"}}
+
+		g.It("match every service when empty", func() {
+			g.Assert(Filter{}.Match("node1", "api", esd)).IsTrue()
+		})
+
+		g.It("match by node, service pattern and tag", func() {
+			g.Assert(Filter{Node: "node1", Service: "a*", Tag: "web"}.Match("node1", "api", esd)).IsTrue()
+			g.Assert(Filter{Node: "node2"}.Match("node1", "api", esd)).IsFalse()
+			g.Assert(Filter{Service: "web-?"}.Match("node1", "api", esd)).IsFalse()
+			g.Assert(Filter{Tag: "db"}.Match("node1", "api", esd)).IsFalse()
+		})
+
+		g.It("reject bad service patterns", func() {
+			g.Assert(Filter{Service: "[a"}.check() != nil).IsTrue()
+		})
+	})
+
+	g.Describe("scheduled backups", func() {
+		now := time.Date(2015, 6, 10, 12, 0, 0, 0, time.UTC)
+		var dir string
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "backups")
+			for _, days := range []int{0, 1, 2, 5, 9} {
+				name := filepath.Join(dir, backupPrefix+now.AddDate(0, 0, -days).Format(backupTimeFormat)+".yaml")
+				ioutil.WriteFile(name, []byte("version: 2\n"), 0644)
+				ioutil.WriteFile(name+ChecksumSuffix, []byte("x\n"), 0644)
+			}
+			ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("keep the last N", func() {
+			removed, err := RotateBackups(dir, BackupRetention{Keep: 2}, now)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(removed)).Equal(3)
+			files, _ := ioutil.ReadDir(dir)
+			g.Assert(len(files)).Equal(5)
+		})
+
+		g.It("keep the last days", func() {
+			removed, _ := RotateBackups(dir, BackupRetention{MaxAge: 3 * 24 * time.Hour}, now)
+			g.Assert(len(removed)).Equal(2)
+		})
+
+		g.It("keep everything without retention", func() {
+			removed, _ := RotateBackups(dir, BackupRetention{}, now)
+			g.Assert(len(removed)).Equal(0)
+		})
+
+		g.It("detect corrupted backups", func() {
+			name := filepath.Join(dir, backupPrefix+now.Format(backupTimeFormat)+".yaml")
+			g.Assert(VerifyBackup(name) != nil).IsTrue()
+		})
+	})
+}
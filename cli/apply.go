@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+)
+
+var planSymbols = map[string]string{
+	cesw.PlanCreate: "+",
+	cesw.PlanUpdate: "~",
+	cesw.PlanDelete: "-",
+}
+
+func printPlan(plan cesw.Plan) {
+	for _, e := range plan {
+		if e.Action == cesw.PlanUnchanged {
+			continue
+		}
+		fmt.Printf("%s %s %s/%s\n", planSymbols[e.Action], e.Action, e.Node, e.Service)
+		if e.Action == cesw.PlanDelete {
+			continue
+		}
+		for _, d := range e.Diffs {
+			fmt.Printf("    %s\n", d)
+		}
+	}
+	fmt.Printf("Plan: %d to create, %d to update, %d to delete, %d unchanged.\n",
+		plan.Count(cesw.PlanCreate), plan.Count(cesw.PlanUpdate), plan.Count(cesw.PlanDelete), plan.Count(cesw.PlanUnchanged))
+}
+
+func runApply(c *cli.Context) {
+	desired, err := cesw.ReadDefinitionsFile(c.String("file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := connect(c)
+	var prune func(string) bool
+	if c.Bool("prune") {
+		prune = cesw.PruneNodesOf(desired)
+	}
+	plan, err := cesw.PlanExternalServices(client, desired, prune)
+	if err != nil {
+		log.Fatalf("computing plan: %v", err)
+	}
+	printPlan(plan)
+	if c.Bool("dry-run") || !plan.Changes() {
+		return
+	}
+	applied, err := cesw.ApplyPlan(client, plan)
+	if err != nil {
+		log.Fatalf("applied %d changes before failing: %v", applied, err)
+	}
+	fmt.Printf("Applied %d changes.\n", applied)
+}
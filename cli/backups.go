@@ -0,0 +1,87 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"os"
+	"time"
+)
+
+var backupFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "backup-dir",
+		Value: "",
+		Usage: "while leading, periodically export every definition to a timestamped file of this directory",
+	},
+	cli.DurationFlag{
+		Name:  "backup-interval",
+		Value: time.Hour,
+		Usage: "time between scheduled backups",
+	},
+	cli.StringFlag{
+		Name:  "backup-format",
+		Value: cesw.FormatYAML,
+		Usage: "format of scheduled backups: yaml, json, hcl or csv",
+	},
+	cli.StringFlag{
+		Name:  "backup-key-file",
+		Value: "",
+		Usage: "encrypt scheduled backups with the key in this file",
+	},
+	cli.IntFlag{
+		Name:  "backup-keep",
+		Value: 0,
+		Usage: "keep the last N scheduled backups",
+	},
+	cli.IntFlag{
+		Name:  "backup-keep-days",
+		Value: 0,
+		Usage: "keep the scheduled backups of the last D days",
+	},
+}
+
+//scheduleBackups writes a backup every interval while watcher leads its node
+//and removes the backups not kept, until stopCh is closed.
+func scheduleBackups(c *cli.Context, watcher *cesw.ExternalServiceWatcher, stopCh chan struct{}) {
+	dir := c.String("backup-dir")
+	retention := cesw.BackupRetention{
+		Keep:   c.Int("backup-keep"),
+		MaxAge: time.Duration(c.Int("backup-keep-days")) * 24 * time.Hour,
+	}
+	logger := log.WithFields(log.Fields{"node": c.String("node"), "dir": dir})
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.WithField("error", err).Error("creating backup directory")
+		return
+	}
+	var enc *cesw.Encryption
+	if c.String("backup-key-file") != "" {
+		enc = &cesw.Encryption{KeyFile: c.String("backup-key-file")}
+	}
+	client := connect(c)
+	ticker := time.NewTicker(c.Duration("backup-interval"))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if !watcher.IsLeader() {
+			continue
+		}
+		fileName, err := cesw.WriteTimestampedBackup(client, dir, c.String("backup-format"), enc, time.Now())
+		if err != nil {
+			logger.WithField("error", err).Error("writing scheduled backup")
+			continue
+		}
+		logger.WithField("file", fileName).Info("Scheduled backup written")
+		removed, err := cesw.RotateBackups(dir, retention, time.Now())
+		if err != nil {
+			logger.WithField("error", err).Error("removing old backups")
+		}
+		for _, name := range removed {
+			logger.WithField("file", name).Info("Old backup removed")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultConsulAddress = "127.0.0.1:8500"
+
+var configFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "config",
+		Value: "",
+		Usage: "configuration file (default ~/.consul-externalservice.yaml)",
+	},
+	cli.StringFlag{
+		Name:   "profile",
+		Value:  "",
+		Usage:  "configuration file profile",
+		EnvVar: "CONSUL_EXTERNALSERVICE_PROFILE",
+	},
+}
+
+//profile holds the consul connection settings of a cluster.
+type profile struct {
+	Address    string `yaml:"address"`
+	Datacenter string `yaml:"datacenter"`
+	Token      string `yaml:"token"`
+}
+
+//config is the content of the configuration file:
+//
+//  default: prod
+//  profiles:
+//    prod:
+//      address: consul.prod:8500
+//      datacenter: dc1
+//      token: secret
+type config struct {
+	Default  string             `yaml:"default"`
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+func defaultConfigFile() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".consul-externalservice.yaml")
+}
+
+//loadConfig reads the configuration file. A missing default configuration
+//file is not an error.
+func loadConfig(fileName string) (*config, error) {
+	explicit := fileName != ""
+	if !explicit {
+		fileName = defaultConfigFile()
+	}
+	cfg := &config{}
+	if fileName == "" {
+		return cfg, nil
+	}
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if fi, err := os.Stat(fileName); err == nil && fi.Mode().Perm()&0077 != 0 {
+		log.WithField("file", fileName).Warn("Configuration file is readable by other users and may contain tokens")
+	}
+	return cfg, nil
+}
+
+//consulSettings resolves the consul address, datacenter and token. They
+//come together from a single source, so the token of one cluster is never
+//sent to another: the profile given with --profile, else the environment
+//(CONSUL_HTTP_ADDR, CONSUL_EXTERNALSERVICE_DATACENTER, CONSUL_HTTP_TOKEN) if
+//any of them is set, else the default profile of the configuration file.
+//Command line flags override single settings. The address may be a URL; an
+//address from the environment without a scheme uses https if CONSUL_HTTP_SSL
+//is true.
+func consulSettings(c *cli.Context) (profile, error) {
+	cfg, err := loadConfig(c.GlobalString("config"))
+	if err != nil {
+		return profile{}, err
+	}
+	fromProfile := func(name string) (profile, error) {
+		p, ok := cfg.Profiles[name]
+		if !ok {
+			return p, fmt.Errorf("unknown profile %q", name)
+		}
+		return p, nil
+	}
+	env := profile{
+		Address:    os.Getenv("CONSUL_HTTP_ADDR"),
+		Datacenter: os.Getenv("CONSUL_EXTERNALSERVICE_DATACENTER"),
+		Token:      os.Getenv("CONSUL_HTTP_TOKEN"),
+	}
+	var settings profile
+	switch {
+	case c.GlobalString("profile") != "":
+		settings, err = fromProfile(c.GlobalString("profile"))
+	case env != profile{}:
+		settings = env
+		if settings.Address == "" {
+			settings.Address = defaultConsulAddress
+		}
+		if ssl, _ := strconv.ParseBool(os.Getenv("CONSUL_HTTP_SSL")); ssl && !strings.Contains(settings.Address, "://") {
+			settings.Address = "https://" + settings.Address
+		}
+	case cfg.Default != "":
+		settings, err = fromProfile(cfg.Default)
+	}
+	if err != nil {
+		return settings, err
+	}
+	if settings.Address == "" {
+		settings.Address = defaultConsulAddress
+	}
+	pick := func(value *string, flag string) {
+		if v := c.GlobalString(flag); v != "" {
+			*value = v
+		}
+	}
+	pick(&settings.Address, "address")
+	pick(&settings.Datacenter, "dc")
+	pick(&settings.Token, "token")
+	return settings, nil
+}
+
+//connect connects to consul with the settings resolved by consulSettings.
+func connect(c *cli.Context) *cesw.Client {
+	settings, err := consulSettings(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cesw.Connect(settings.Address, settings.Datacenter, settings.Token)
+}
@@ -18,8 +18,8 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "address",
-			Value: "127.0.0.1:8500",
-			Usage: "consul address",
+			Value: "",
+			Usage: "consul address or URL (default " + defaultConsulAddress + ")",
 		},
 		cli.StringFlag{
 			Name:  "dc",
@@ -32,6 +32,9 @@ func main() {
 			Usage: "consul token",
 		},
 	}
+	app.Flags = append(app.Flags, configFlags...)
+	app.Flags = append(app.Flags, logFlags...)
+	app.Before = configureLogging
 	app.Commands = []cli.Command{
 		{
 			Name:      "version",
@@ -45,24 +48,46 @@ func main() {
 			Name:      "start",
 			ShortName: "s",
 			Usage:     "start service watcher",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "node",
 					Value: "node1",
 					Usage: "node name",
 				},
-			},
+				cli.StringFlag{
+					Name:  "event",
+					Value: "",
+					Usage: "fire a consul user event with this name when a service is registered or deregistered (e.g. " + cesw.DefaultTransitionEvent + ")",
+				},
+				cli.StringFlag{
+					Name:  "http",
+					Value: "",
+					Usage: "serve a read only status page on this address (e.g. :8080)",
+				},
+			}, backupFlags...),
 			Action: func(c *cli.Context) {
-				client := cesw.Connect(c.GlobalString("address"), c.GlobalString("datacenter"), c.GlobalString("token"))
+				client := connect(c)
 				watcher := cesw.NewExternalServiceWatcher(client, c.String("node"))
 				if watcher != nil {
-					log.Printf("Starting external service watcher for node %s ...\n", c.String("node"))
+					watcher.SetTransitionEvent(c.String("event"))
+					if c.String("http") != "" {
+						go func() {
+							if err := serveDashboard(client, c.String("http"), c.String("node")); err != nil {
+								log.WithField("error", err).Error("serving status page")
+							}
+						}()
+					}
+					logger := log.WithField("node", c.String("node"))
+					logger.Info("Starting external service watcher ...")
 					stopCh := make(chan struct{})
+					if c.String("backup-dir") != "" {
+						go scheduleBackups(c, watcher, stopCh)
+					}
 					go func() {
 					TRY_LEADERSHIP:
 						watcher.Run()
 						if watcher.IsLeader() {
-							log.Info("I am the leader now ...")
+							logger.WithField("leader", true).Info("I am the leader now ...")
 						}
 					WAIT_FOR_EVENT:
 						select {
@@ -71,10 +96,10 @@ func main() {
 							return
 						case <-time.After(10 * time.Second):
 							if watcher.IsLeader() {
-								log.Info("I am still the leader ...")
+								logger.WithField("leader", true).Info("I am still the leader ...")
 								goto WAIT_FOR_EVENT
 							} else {
-								log.Info("Trying to be leader ...")
+								logger.WithField("leader", false).Info("Trying to be leader ...")
 								goto TRY_LEADERSHIP
 							}
 						}
@@ -85,11 +110,11 @@ func main() {
 					signal.Notify(signalCh, os.Interrupt, os.Kill)
 					select {
 					case <-signalCh:
-						log.Warn("Received signal, stopping service watch ...")
+						logger.Warn("Received signal, stopping service watch ...")
 						close(stopCh)
 					}
 				} else {
-					log.Error("Error starting external service watcher. Check consul agent is running on localhost:8500. Exiting ...")
+					log.WithField("node", c.String("node")).Error("Error starting external service watcher. Check consul agent is running on localhost:8500. Exiting ...")
 				}
 			},
 		},
@@ -97,35 +122,334 @@ func main() {
 			Name:      "export",
 			ShortName: "e",
 			Usage:     "export service definitions",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "file",
 					Value: "export.yaml",
 					Usage: "export file name",
 				},
-			},
-			Action: func(c *cli.Context) {
-				client := cesw.Connect(c.GlobalString("address"), c.GlobalString("datacenter"), c.GlobalString("token"))
-				log.Infof("Exporting services to %s", c.String("file"))
-				cesw.BackupExternalServicesToYAML(client, c.String("file"))
-			},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "yaml, json, hcl or csv (default from the file extension)",
+				},
+			}, append(filterFlags, encryptionFlags...)...),
+			Action: runExport,
 		},
 		{
 			Name:      "import",
 			ShortName: "i",
 			Usage:     "import service definitions",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "file",
 					Value: "export.yaml",
 					Usage: "import file name",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "yaml, json, hcl or csv (default from the file extension)",
+				},
+				cli.StringFlag{
+					Name:  "mode",
+					Value: cesw.RestoreOverwrite,
+					Usage: "existing definitions: overwrite, skip-existing or fail-if-exists",
+				},
+				cli.BoolFlag{
+					Name:  "continue-on-error",
+					Usage: "write keys one by one restoring every key possible instead of all or nothing",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Value: "",
+					Usage: "consul-service to convert consul agent service definitions into services of --node",
+				},
+			}, append(filterFlags, encryptionFlags...)...),
+			Action: runImport,
+		},
+		{
+			Name:  "snapshot",
+			Usage: "save definitions, catalog entries, checks and watchers of the external services",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "snapshot.yaml",
+					Usage: "snapshot file name",
+				},
+			}, encryptionFlags...),
+			Action: runSnapshot,
+		},
+		{
+			Name:  "restore-snapshot",
+			Usage: "restore a snapshot taken with snapshot",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "snapshot.yaml",
+					Usage: "snapshot file name",
+				},
+				cli.BoolFlag{
+					Name:  "rebuild",
+					Usage: "also register the catalog entries and checks, without waiting for a watcher",
+				},
+			}, encryptionFlags...),
+			Action: runRestoreSnapshot,
+		},
+		{
+			Name:  "create",
+			Usage: "define an external service",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "node",
+					Value: "",
+					Usage: "external node name",
+				},
+				cli.StringFlag{
+					Name:  "service",
+					Value: "",
+					Usage: "service name",
+				},
+				cli.StringFlag{
+					Name:  "address",
+					Value: "",
+					Usage: "service address",
+				},
+				cli.IntFlag{
+					Name:  "port",
+					Value: 0,
+					Usage: "service port",
+				},
+				cli.StringFlag{
+					Name:  "command",
+					Value: "",
+					Usage: "check command",
+				},
+				cli.StringFlag{
+					Name:  "check-type",
+					Value: cesw.CheckScript,
+					Usage: "check type: script or ttl",
+				},
+				cli.StringFlag{
+					Name:  "interval",
+					Value: "10s",
+					Usage: "check interval, or TTL of ttl checks",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag",
+					Value: &cli.StringSlice{},
+					Usage: "service tag, can be repeated",
+				},
+				cli.StringFlag{
+					Name:  "state",
+					Value: "stopped",
+					Usage: "initial target state: running or stopped",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "overwrite an existing definition",
+				},
 			},
-			Action: func(c *cli.Context) {
-				client := cesw.Connect(c.GlobalString("address"), c.GlobalString("datacenter"), c.GlobalString("token"))
-				log.Infof("Importing services from %s", c.String("file"))
-				cesw.RestoreExternalServicesFromYAML(client, c.String("file"))
+			Action: runCreate,
+		},
+		{
+			Name:      "list",
+			ShortName: "l",
+			Usage:     "list external services with their catalog and check status",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "node",
+					Value: "",
+					Usage: "only list services of this node",
+				},
+				cli.StringFlag{
+					Name:  "tag",
+					Value: "",
+					Usage: "only list services with this tag",
+				},
+				cli.StringFlag{
+					Name:  "state",
+					Value: "",
+					Usage: "only list services with this target state",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "table",
+					Usage: "output format: table, json or yaml",
+				},
+			},
+			Action: runList,
+		},
+		{
+			Name:   "enable",
+			Usage:  "set the target state of the selected services to running",
+			Flags:  lifecycleFlags(),
+			Action: setTargetState("running"),
+		},
+		{
+			Name:   "disable",
+			Usage:  "set the target state of the selected services to stopped",
+			Flags:  lifecycleFlags(),
+			Action: setTargetState("stopped"),
+		},
+		{
+			Name:   "remove",
+			Usage:  "set the target state of the selected services to deleted",
+			Flags:  lifecycleFlags(),
+			Action: setTargetState("deleted"),
+		},
+		{
+			Name:   "edit",
+			Usage:  "edit <node> <service>: edit a service definition with $EDITOR",
+			Action: runEdit,
+		},
+		{
+			Name:   "revisions",
+			Usage:  "revisions <node> <service>: list the previous definitions of a service",
+			Action: runRevisions,
+		},
+		{
+			Name:  "rollback",
+			Usage: "rollback <node> <service> --to <rev>: restore a previous definition of a service",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "to",
+					Value: 0,
+					Usage: "revision to restore, as listed by revisions",
+				},
+			},
+			Action: runRollback,
+		},
+		{
+			Name:  "apply",
+			Usage: "make the service definitions match a file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "services.yaml",
+					Usage: "definitions file name",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only print the plan",
+				},
+				cli.BoolFlag{
+					Name:  "prune",
+					Usage: "delete services of the nodes in the file that are not in it",
+				},
+			},
+			Action: runApply,
+		},
+		{
+			Name:  "diff",
+			Usage: "compare the service definitions with a file, exit status 1 on drift",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "services.yaml",
+					Usage: "definitions file name",
+				},
+				cli.StringFlag{
+					Name:  "node",
+					Value: "",
+					Usage: "only compare services of this node",
+				},
+			},
+			Action: runDiff,
+		},
+		{
+			Name:  "validate",
+			Usage: "check a definitions file without contacting consul",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Value: "services.yaml",
+					Usage: "definitions file name",
+				},
+			},
+			Action: runValidate,
+		},
+		{
+			Name:      "watch",
+			ShortName: "w",
+			Usage:     "stream changes of definitions, checks and catalog registrations",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "node",
+					Value: "",
+					Usage: "only watch services of this node",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "output format: text or json (one object per line)",
+				},
+			},
+			Action: runWatch,
+		},
+		{
+			Name:      "top",
+			ShortName: "t",
+			Usage:     "interactive dashboard of external services",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "node",
+					Value: "",
+					Usage: "only show services of this node",
+				},
+			},
+			Action: runTop,
+		},
+		{
+			Name:      "report",
+			ShortName: "r",
+			Usage:     "report service availability from recorded health transitions",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "node",
+					Value: "",
+					Usage: "only report services of this node",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Value: "",
+					Usage: "window start (RFC3339 or YYYY-MM-DD), defaults to 30 days ago",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Value: "",
+					Usage: "window end (RFC3339 or YYYY-MM-DD), defaults to now",
+				},
+				cli.StringFlag{
+					Name:  "month",
+					Value: "",
+					Usage: "report a whole calendar month (YYYY-MM)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "table",
+					Usage: "output format: table, json or csv",
+				},
+			},
+			Action: runReport,
+		},
+		{
+			Name:      "dashboard",
+			ShortName: "d",
+			Usage:     "serve a read only status page of the external services",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: ":8080",
+					Usage: "address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "node",
+					Value: "",
+					Usage: "only show services of this node",
+				},
 			},
+			Action: runDashboard,
 		},
 	}
 	app.Run(os.Args)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+)
+
+func runCreate(c *cli.Context) {
+	node, service := c.String("node"), c.String("service")
+	if err := cesw.ValidateName("node", node); err != nil {
+		log.Fatal(err)
+	}
+	if err := cesw.ValidateName("service", service); err != nil {
+		log.Fatal(err)
+	}
+	esd := &cesw.ExternalServiceDefinition{
+		Address:     c.String("address"),
+		Port:        c.Int("port"),
+		Command:     c.String("command"),
+		Interval:    c.String("interval"),
+		TargetState: c.String("state"),
+		Tags:        c.StringSlice("tag"),
+		CheckType:   c.String("check-type"),
+	}
+	if esd.TargetState == "deleted" {
+		log.Fatal("initial target state must be running or stopped")
+	}
+	if err := esd.Validate(); err != nil {
+		log.Fatalf("invalid definition of %s/%s: %v", node, service, err)
+	}
+
+	client := connect(c)
+	es := cesw.NewExternalServiceFromDefinition(client, service, node, esd)
+	save := func() error { return es.SaveCAS(0) }
+	if c.Bool("force") {
+		save = es.Save
+	}
+	//Without --force the definition is only created if the key does not
+	//exist when it is written, so concurrent creates cannot overwrite it.
+	if err := save(); err == cesw.ErrConflict {
+		log.Fatalf("%s/%s is already defined, use --force to overwrite it", node, service)
+	} else if err != nil {
+		log.Fatalf("saving %s/%s: %v", node, service, err)
+	}
+	log.WithFields(log.Fields{"node": node, "service": service, "state": esd.TargetState}).Info("External service defined")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>External services</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 2em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+pre { margin: 0; max-width: 40em; white-space: pre-wrap; }
+ul { margin: 0; padding-left: 1em; }
+.passing { background: #cfc; }
+.warning { background: #ffc; }
+.critical { background: #fcc; }
+</style>
+</head>
+<body>
+<h1>External services</h1>
+<p>Updated {{time .Now}}</p>
+{{if .Error}}<p class="critical">{{.Error}}</p>{{end}}
+<table>
+<tr><th>Node</th><th>Service</th><th>Address</th><th>Desired state</th><th>Catalog</th><th>Check</th><th>Last output</th><th>Recent transitions</th></tr>
+{{range .Services}}
+<tr>
+<td>{{.Node}}</td>
+<td>{{.Service}}</td>
+<td>{{.Definition.Address}}:{{.Definition.Port}}</td>
+<td>{{.Definition.TargetState}}</td>
+<td>{{if .Registered}}registered{{else}}not registered{{end}}</td>
+<td class="{{.CheckStatus}}">{{.CheckStatus}}</td>
+<td><pre>{{.CheckOutput}}</pre></td>
+<td><ul>{{range .Transitions}}<li>{{time .Time}} {{.From}} &rarr; {{.To}}</li>{{end}}</ul></td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+//dashboardHandler serves a read only HTML page with the status of the
+//external services of node, or of every node if node is empty.
+func dashboardHandler(client *cesw.Client, node string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		data := struct {
+			Now      time.Time
+			Services []*cesw.ExternalServiceStatus
+			Error    string
+		}{Now: time.Now()}
+		services, err := cesw.ExternalServicesStatus(client, node, 5)
+		if err != nil {
+			log.WithField("error", err).Error("getting external services status")
+			data.Error = err.Error()
+		}
+		data.Services = services
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, data); err != nil {
+			log.WithField("error", err).Error("rendering dashboard")
+		}
+	})
+}
+
+func serveDashboard(client *cesw.Client, listen, node string) error {
+	log.WithField("listen", listen).Info("Serving status page ...")
+	return http.ListenAndServe(listen, dashboardHandler(client, node))
+}
+
+func runDashboard(c *cli.Context) {
+	client := connect(c)
+	if err := serveDashboard(client, c.String("listen"), c.String("node")); err != nil {
+		log.Fatal(err)
+	}
+}
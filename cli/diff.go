@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"os"
+)
+
+//runDiff exits with status 0 when consul matches the file, 1 when they
+//differ and 2 when they cannot be compared. Services only in consul are
+//drift on every node, or on the given one, whether the file has services of
+//their node or not.
+func runDiff(c *cli.Context) {
+	fail := func(err error) {
+		log.Error(err)
+		os.Exit(2)
+	}
+	defs, err := cesw.ReadDefinitionsFile(c.String("file"))
+	if err != nil {
+		fail(err)
+	}
+	node := c.String("node")
+	var desired []*cesw.NamedDefinition
+	for _, nd := range defs {
+		if node == "" || nd.Node == node {
+			desired = append(desired, nd)
+		}
+	}
+	prune := cesw.PruneNodes()
+	if node != "" {
+		prune = cesw.PruneNodes(node)
+	}
+	client := connect(c)
+	plan, err := cesw.PlanExternalServices(client, desired, prune)
+	if err != nil {
+		fail(err)
+	}
+
+	drift := false
+	for _, e := range plan {
+		switch e.Action {
+		case cesw.PlanCreate:
+			fmt.Printf("+ %s/%s: only in %s\n", e.Node, e.Service, c.String("file"))
+		case cesw.PlanDelete:
+			fmt.Printf("- %s/%s: only in consul\n", e.Node, e.Service)
+		case cesw.PlanUpdate:
+			fmt.Printf("~ %s/%s:\n", e.Node, e.Service)
+			for _, d := range e.Diffs {
+				fmt.Printf("    %s: consul %s, file %s\n", d.Field, d.Old, d.New)
+			}
+		default:
+			continue
+		}
+		drift = true
+	}
+	if drift {
+		os.Exit(1)
+	}
+	fmt.Println("In sync.")
+}
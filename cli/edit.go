@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+var definitionFields = map[string]bool{"address": true, "port": true, "command": true, "state": true,
+	"interval": true, "targetstate": true, "tags": true, "checktype": true}
+
+//parseEditedDefinition decodes and validates a definition edited as YAML.
+func parseEditedDefinition(b []byte) (*cesw.ExternalServiceDefinition, error) {
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	var unknown []string
+	for k := range fields {
+		if !definitionFields[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", "))
+	}
+	var esd cesw.ExternalServiceDefinition
+	if err := yaml.Unmarshal(b, &esd); err != nil {
+		return nil, err
+	}
+	if err := esd.Validate(); err != nil {
+		return nil, err
+	}
+	return &esd, nil
+}
+
+func runEditor(fileName string) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	args := append(strings.Fields(editor), fileName)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func printDiffs(title string, diffs []cesw.FieldDiff) {
+	fmt.Println(title)
+	for _, d := range diffs {
+		fmt.Printf("  %s\n", d)
+	}
+}
+
+func runEdit(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		log.Fatal("usage: edit <node> <service>")
+	}
+	node, service := c.Args().Get(0), c.Args().Get(1)
+	client := connect(c)
+	es, index, err := cesw.LoadExternalService(client, service, node)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if es == nil {
+		log.Fatalf("%s/%s is not defined", node, service)
+	}
+	original, err := yaml.Marshal(es.Definition())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "consul-externalservice-edit-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileName := f.Name()
+	f.Close()
+
+	header := fmt.Sprintf("# Editing ExternalServices/%s/%s. Save and quit to apply, or leave unchanged to cancel.\n", node, service)
+	content := append([]byte(header), original...)
+	var edited *cesw.ExternalServiceDefinition
+	for {
+		if err := ioutil.WriteFile(fileName, content, 0600); err != nil {
+			log.Fatal(err)
+		}
+		if err := runEditor(fileName); err != nil {
+			os.Remove(fileName)
+			log.Fatalf("running editor: %v", err)
+		}
+		saved, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if bytes.Equal(saved, content) {
+			os.Remove(fileName)
+			fmt.Println("Edit cancelled, no changes made.")
+			return
+		}
+		edited, err = parseEditedDefinition(saved)
+		if err == nil {
+			break
+		}
+		//reopen the editor with the problem on top of the user's text
+		var body []string
+		for _, l := range strings.Split(string(saved), "\n") {
+			if !strings.HasPrefix(l, "# error:") {
+				body = append(body, l)
+			}
+		}
+		content = []byte(fmt.Sprintf("# error: %v\n%s", err, strings.Join(body, "\n")))
+	}
+
+	diffs := cesw.DiffDefinitions(es.Definition(), edited)
+	if len(diffs) == 0 {
+		os.Remove(fileName)
+		fmt.Println("No changes made.")
+		return
+	}
+	updated := cesw.NewExternalServiceFromDefinition(client, service, node, edited)
+	err = updated.SaveCAS(index)
+	if err == cesw.ErrConflict {
+		current, _, lerr := cesw.LoadExternalService(client, service, node)
+		if lerr != nil {
+			log.Fatal(lerr)
+		}
+		if current == nil {
+			fmt.Printf("%s/%s has been deleted while you were editing it.\n", node, service)
+		} else {
+			printDiffs(fmt.Sprintf("%s/%s has been changed while you were editing it:", node, service),
+				cesw.DiffDefinitions(es.Definition(), current.Definition()))
+		}
+		fmt.Printf("Your changes were NOT saved, they are kept in %s\n", fileName)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("saving %s/%s: %v (your changes are kept in %s)", node, service, err, fileName)
+	}
+	os.Remove(fileName)
+	printDiffs(fmt.Sprintf("%s/%s saved:", node, service), diffs)
+}
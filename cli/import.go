@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"os"
+)
+
+var filterFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "node",
+		Value: "",
+		Usage: "only the services of this node",
+	},
+	cli.StringFlag{
+		Name:  "service",
+		Value: "",
+		Usage: "only the services whose name matches this pattern, like 'web-*'",
+	},
+	cli.StringFlag{
+		Name:  "tag",
+		Value: "",
+		Usage: "only the services with this tag",
+	},
+}
+
+var encryptionFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "passphrase",
+		Value:  "",
+		Usage:  "encrypt or decrypt the file with this passphrase",
+		EnvVar: "CONSUL_EXTERNALSERVICE_PASSPHRASE",
+	},
+	cli.StringFlag{
+		Name:  "key-file",
+		Value: "",
+		Usage: "encrypt or decrypt the file with the key in this file",
+	},
+}
+
+//encryptionFromFlags returns the encryption selected by the flags, or nil.
+func encryptionFromFlags(c *cli.Context) *cesw.Encryption {
+	if c.String("passphrase") == "" && c.String("key-file") == "" {
+		return nil
+	}
+	return &cesw.Encryption{Passphrase: c.String("passphrase"), KeyFile: c.String("key-file")}
+}
+
+func filterFromFlags(c *cli.Context) cesw.Filter {
+	return cesw.Filter{Node: c.String("node"), Service: c.String("service"), Tag: c.String("tag")}
+}
+
+func printRestoreSummary(s *cesw.RestoreSummary) {
+	fmt.Printf("%d keys restored.\n", len(s.Restored))
+	if len(s.Excluded) > 0 {
+		fmt.Printf("%d keys excluded by the filters.\n", len(s.Excluded))
+	}
+	for _, key := range s.Skipped {
+		fmt.Printf("  skipped %s\n", key)
+	}
+	for _, key := range s.Existing {
+		fmt.Printf("  kept existing %s\n", key)
+	}
+	for _, e := range s.Failed {
+		fmt.Printf("  failed %s: %v\n", e.Key, e.Err)
+	}
+	for _, key := range s.NotAttempted {
+		fmt.Printf("  not restored %s\n", key)
+	}
+	for _, u := range s.Unmapped {
+		fmt.Printf("  not mapped %s\n", u)
+	}
+}
+
+func runExport(c *cli.Context) {
+	client := connect(c)
+	log.Infof("Exporting services to %s", c.String("file"))
+	opts := &cesw.BackupOptions{Format: c.String("format"), Filter: filterFromFlags(c), Encryption: encryptionFromFlags(c)}
+	if err := cesw.BackupExternalServices(client, c.String("file"), opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runImport(c *cli.Context) {
+	client := connect(c)
+	log.Infof("Importing services from %s", c.String("file"))
+	summary, err := cesw.RestoreExternalServices(client, c.String("file"), &cesw.RestoreOptions{
+		Format:          c.String("format"),
+		Mode:            c.String("mode"),
+		Filter:          filterFromFlags(c),
+		Encryption:      encryptionFromFlags(c),
+		ContinueOnError: c.Bool("continue-on-error"),
+		From:            c.String("from"),
+		Node:            c.String("node"),
+	})
+	if summary != nil {
+		printRestoreSummary(summary)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
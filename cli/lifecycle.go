@@ -0,0 +1,92 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"os"
+	"time"
+)
+
+var selectorFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "node",
+		Value: "",
+		Usage: "select the services of this node",
+	},
+	cli.StringFlag{
+		Name:  "service",
+		Value: "",
+		Usage: "select the service with this name",
+	},
+	cli.StringFlag{
+		Name:  "tag",
+		Value: "",
+		Usage: "select the services with this tag",
+	},
+}
+
+var waitFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "wait",
+		Usage: "wait until the watchers have converged the catalog",
+	},
+	cli.DurationFlag{
+		Name:  "timeout",
+		Value: time.Minute,
+		Usage: "maximum time to wait",
+	},
+}
+
+func lifecycleFlags() []cli.Flag {
+	return append(append([]cli.Flag{}, selectorFlags...), waitFlags...)
+}
+
+//selectServices returns the services matching the selector flags. At least
+//one selector is required so a typo cannot select every service.
+func selectServices(c *cli.Context) []*cesw.ExternalService {
+	if c.String("node") == "" && c.String("service") == "" && c.String("tag") == "" {
+		log.Fatal("select services with --node, --service and/or --tag")
+	}
+	client := connect(c)
+	services, err := cesw.ListExternalServices(client, c.String("node"))
+	if err != nil {
+		log.Fatalf("listing external services: %v", err)
+	}
+	var selected []*cesw.ExternalService
+	for _, es := range services {
+		if c.String("service") != "" && es.Service() != c.String("service") {
+			continue
+		}
+		if c.String("tag") != "" && !hasTag(es.Definition().Tags, c.String("tag")) {
+			continue
+		}
+		selected = append(selected, es)
+	}
+	if len(selected) == 0 {
+		log.Fatal("no external service matches the selection")
+	}
+	return selected
+}
+
+//setTargetState returns the action of the commands that change the target
+//state of the selected services.
+func setTargetState(state string) func(c *cli.Context) {
+	return func(c *cli.Context) {
+		services := selectServices(c)
+		for _, es := range services {
+			if err := es.SetTargetState(state); err != nil {
+				log.Fatalf("setting %s/%s %s: %v", es.Node(), es.Service(), state, err)
+			}
+			log.WithFields(log.Fields{"node": es.Node(), "service": es.Service(), "state": state}).Info("Target state set")
+		}
+		if !c.Bool("wait") {
+			return
+		}
+		if err := cesw.WaitConverged(services, c.Duration("timeout")); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		log.Info("Catalog converged")
+	}
+}
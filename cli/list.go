@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type listRow struct {
+	Node        string   `json:"node" yaml:"node"`
+	Service     string   `json:"service" yaml:"service"`
+	Address     string   `json:"address" yaml:"address"`
+	Port        int      `json:"port" yaml:"port"`
+	Tags        []string `json:"tags" yaml:"tags"`
+	TargetState string   `json:"target_state" yaml:"target_state"`
+	Registered  bool     `json:"registered" yaml:"registered"`
+	CheckStatus string   `json:"check_status" yaml:"check_status"`
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func runList(c *cli.Context) {
+	format := c.String("format")
+	if format != "table" && format != "json" && format != "yaml" {
+		log.Fatalf("unknown format %q, expected table, json or yaml", format)
+	}
+	client := connect(c)
+	statuses, err := cesw.ExternalServicesStatus(client, c.String("node"), 0)
+	if err != nil {
+		log.Fatalf("listing external services: %v", err)
+	}
+
+	rows := []listRow{}
+	for _, st := range statuses {
+		if c.String("tag") != "" && !hasTag(st.Definition.Tags, c.String("tag")) {
+			continue
+		}
+		if c.String("state") != "" && st.Definition.TargetState != c.String("state") {
+			continue
+		}
+		rows = append(rows, listRow{Node: st.Node, Service: st.Service, Address: st.Definition.Address, Port: st.Definition.Port,
+			Tags: st.Definition.Tags, TargetState: st.Definition.TargetState, Registered: st.Registered, CheckStatus: st.CheckStatus})
+	}
+
+	switch format {
+	case "json":
+		if err := json.NewEncoder(os.Stdout).Encode(rows); err != nil {
+			log.Fatal(err)
+		}
+	case "yaml":
+		b, err := yaml.Marshal(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(b)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tSERVICE\tADDRESS\tTAGS\tTARGET\tCATALOG\tCHECK")
+		for _, r := range rows {
+			catalog := "-"
+			if r.Registered {
+				catalog = "registered"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s:%d\t%s\t%s\t%s\t%s\n", r.Node, r.Service, r.Address, r.Port,
+				strings.Join(r.Tags, ","), r.TargetState, catalog, r.CheckStatus)
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"os"
+)
+
+var logFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "log-level",
+		Value: "info",
+		Usage: "log level: debug, info, warning, error, fatal or panic",
+	},
+	cli.StringFlag{
+		Name:  "log-format",
+		Value: "text",
+		Usage: "log format: text or json",
+	},
+	cli.StringFlag{
+		Name:  "log-file",
+		Value: "",
+		Usage: "append logs to this file instead of stderr",
+	},
+	cli.StringFlag{
+		Name:  "log-sink",
+		Value: "stderr",
+		Usage: "comma separated log sinks: stderr, syslog and journald",
+	},
+	cli.StringFlag{
+		Name:  "syslog-tag",
+		Value: "consul-externalservice",
+		Usage: "syslog tag and journal identifier of the log lines",
+	},
+}
+
+//configureLogging sets up logrus from the global log flags.
+func configureLogging(c *cli.Context) error {
+	level, err := log.ParseLevel(c.GlobalString("log-level"))
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+
+	switch c.GlobalString("log-format") {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", c.GlobalString("log-format"))
+	}
+
+	stderr, err := addLogSinks(c.GlobalString("log-sink"), c.GlobalString("syslog-tag"))
+	if err != nil {
+		return err
+	}
+	if !stderr {
+		log.SetOutput(ioutil.Discard)
+	}
+	if c.GlobalString("log-file") != "" {
+		f, err := os.OpenFile(c.GlobalString("log-file"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
+	"github.com/coreos/go-systemd/journal"
+	"log/syslog"
+	"strings"
+)
+
+var allLevels = []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel}
+
+//journaldHook sends log entries to the systemd journal socket. Entry fields
+//become journal fields, so they can be queried with journalctl.
+type journaldHook struct {
+	identifier string
+}
+
+func (h *journaldHook) Levels() []log.Level {
+	return allLevels
+}
+
+func (h *journaldHook) Fire(entry *log.Entry) error {
+	vars := map[string]string{"SYSLOG_IDENTIFIER": h.identifier}
+	for k, v := range entry.Data {
+		vars[journalFieldName(k)] = fmt.Sprint(v)
+	}
+	return journal.Send(entry.Message, journalPriority(entry.Level), vars)
+}
+
+//journalFieldName maps a logrus field name to a valid journal field name:
+//uppercase letters, digits and underscores, not starting with an underscore.
+func journalFieldName(name string) string {
+	n := strings.TrimLeft(strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, name), "_")
+	if n == "" {
+		return "FIELD"
+	}
+	return n
+}
+
+func journalPriority(level log.Level) journal.Priority {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return journal.PriCrit
+	case log.ErrorLevel:
+		return journal.PriErr
+	case log.WarnLevel:
+		return journal.PriWarning
+	case log.InfoLevel:
+		return journal.PriInfo
+	}
+	return journal.PriDebug
+}
+
+//addLogSinks installs the hooks of the syslog and journald sinks and
+//reports whether the stderr sink was selected.
+func addLogSinks(sinks, tag string) (bool, error) {
+	stderr := false
+	for _, sink := range strings.Split(sinks, ",") {
+		switch strings.TrimSpace(sink) {
+		case "stderr":
+			stderr = true
+		case "syslog":
+			hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+			if err != nil {
+				return stderr, fmt.Errorf("connecting to local syslog: %v", err)
+			}
+			log.AddHook(hook)
+		case "journald":
+			if !journal.Enabled() {
+				return stderr, fmt.Errorf("systemd journal socket is not available")
+			}
+			log.AddHook(&journaldHook{identifier: tag})
+		default:
+			return stderr, fmt.Errorf("unknown log sink %q, expected stderr, syslog or journald", sink)
+		}
+	}
+	return stderr, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"math"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+type reportRow struct {
+	Node          string   `json:"node"`
+	Service       string   `json:"service,omitempty"`
+	Uptime        *float64 `json:"uptime_percent"`
+	Outages       int      `json:"outages"`
+	MTTR          float64  `json:"mttr_seconds"`
+	LongestOutage float64  `json:"longest_outage_seconds"`
+	Monitored     float64  `json:"monitored_seconds"`
+}
+
+//newReportRow converts r, leaving Uptime nil if the service was never
+//monitored during the window.
+func newReportRow(r *cesw.AvailabilityReport) reportRow {
+	row := reportRow{Node: r.Node, Service: r.Service, Outages: r.Outages,
+		MTTR: r.MTTR().Seconds(), LongestOutage: r.LongestOutage.Seconds(), Monitored: r.Monitored.Seconds()}
+	if uptime := r.Uptime(); !math.IsNaN(uptime) {
+		row.Uptime = &uptime
+	}
+	return row
+}
+
+func parseReportTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+//reportWindow returns the window selected by the --month or --from/--to
+//flags. It defaults to the last 30 days.
+func reportWindow(c *cli.Context) (time.Time, time.Time, error) {
+	to := time.Now()
+	from := to.Add(-30 * 24 * time.Hour)
+	if c.String("month") != "" {
+		m, err := time.ParseInLocation("2006-01", c.String("month"), time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid month %q, expected YYYY-MM", c.String("month"))
+		}
+		return m, m.AddDate(0, 1, 0), nil
+	}
+	var err error
+	if c.String("from") != "" {
+		if from, err = parseReportTime(c.String("from")); err != nil {
+			return from, to, fmt.Errorf("invalid --from: %v", err)
+		}
+	}
+	if c.String("to") != "" {
+		if to, err = parseReportTime(c.String("to")); err != nil {
+			return from, to, fmt.Errorf("invalid --to: %v", err)
+		}
+	}
+	if !to.After(from) {
+		return from, to, fmt.Errorf("--to must be later than --from")
+	}
+	return from, to, nil
+}
+
+func formatUptime(r *cesw.AvailabilityReport) string {
+	if math.IsNaN(r.Uptime()) {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.3f%%", r.Uptime())
+}
+
+func formatDuration(d time.Duration) string {
+	return (d / time.Second * time.Second).String()
+}
+
+func runReport(c *cli.Context) {
+	from, to, err := reportWindow(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := connect(c)
+	services, nodes, err := cesw.AvailabilityReports(client, c.String("node"), from, to)
+	if err != nil {
+		log.Fatalf("computing availability: %v", err)
+	}
+
+	switch c.String("format") {
+	case "json":
+		out := struct {
+			From     time.Time   `json:"from"`
+			To       time.Time   `json:"to"`
+			Services []reportRow `json:"services"`
+			Nodes    []reportRow `json:"nodes"`
+		}{From: from, To: to, Services: []reportRow{}, Nodes: []reportRow{}}
+		for _, r := range services {
+			out.Services = append(out.Services, newReportRow(r))
+		}
+		for _, r := range nodes {
+			out.Nodes = append(out.Nodes, newReportRow(r))
+		}
+		enc := json.NewEncoder(os.Stdout)
+		if err := enc.Encode(out); err != nil {
+			log.Fatal(err)
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"node", "service", "uptime_percent", "outages", "mttr_seconds", "longest_outage_seconds", "monitored_seconds"})
+		for _, r := range append(services, nodes...) {
+			row := newReportRow(r)
+			uptime := ""
+			if row.Uptime != nil {
+				uptime = strconv.FormatFloat(*row.Uptime, 'f', 3, 64)
+			}
+			w.Write([]string{row.Node, row.Service, uptime, strconv.Itoa(row.Outages),
+				strconv.FormatFloat(row.MTTR, 'f', 0, 64), strconv.FormatFloat(row.LongestOutage, 'f', 0, 64),
+				strconv.FormatFloat(row.Monitored, 'f', 0, 64)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Fatal(err)
+		}
+	case "table":
+		fmt.Printf("Availability from %s to %s\n\n", from.Format(time.RFC3339), to.Format(time.RFC3339))
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tSERVICE\tUPTIME\tOUTAGES\tMTTR\tLONGEST OUTAGE")
+		for _, r := range services {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Node, r.Service, formatUptime(r), r.Outages,
+				formatDuration(r.MTTR()), formatDuration(r.LongestOutage))
+		}
+		fmt.Fprintln(w, "\t\t\t\t\t")
+		for _, r := range nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Node, "*", formatUptime(r), r.Outages,
+				formatDuration(r.MTTR()), formatDuration(r.LongestOutage))
+		}
+		w.Flush()
+	default:
+		log.Fatalf("unknown format %q, expected table, json or csv", c.String("format"))
+	}
+}
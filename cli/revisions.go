@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+func runRevisions(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		log.Fatal("usage: revisions <node> <service>")
+	}
+	node, service := c.Args().Get(0), c.Args().Get(1)
+	client := connect(c)
+	revisions, err := cesw.ListRevisions(client, node, service)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(revisions) == 0 {
+		fmt.Printf("No revisions of %s/%s.\n", node, service)
+		return
+	}
+	current, _, err := cesw.LoadExternalService(client, service, node)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Every revision is described by the changes made when it was replaced.
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REV\tREPLACED AT\tREPLACED BY\tCHANGES")
+	for i := len(revisions) - 1; i >= 0; i-- {
+		r := revisions[i]
+		var next *cesw.ExternalServiceDefinition
+		if i+1 < len(revisions) {
+			next = revisions[i+1].Definition
+		} else if current != nil {
+			next = current.Definition()
+		}
+		var changes []string
+		for _, d := range cesw.DiffDefinitions(r.Definition, next) {
+			changes = append(changes, d.String())
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.Number, r.Time.Format("2006-01-02 15:04:05"), r.Author, strings.Join(changes, ", "))
+	}
+	w.Flush()
+}
+
+func runRollback(c *cli.Context) {
+	if len(c.Args()) != 2 || c.Int("to") <= 0 {
+		log.Fatal("usage: rollback <node> <service> --to <rev>")
+	}
+	node, service := c.Args().Get(0), c.Args().Get(1)
+	client := connect(c)
+	diffs, err := cesw.RollbackExternalService(client, node, service, c.Int("to"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(diffs) == 0 {
+		fmt.Printf("%s/%s already matches revision %d.\n", node, service, c.Int("to"))
+		return
+	}
+	printDiffs(fmt.Sprintf("%s/%s rolled back to revision %d:", node, service, c.Int("to")), diffs)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+)
+
+func runSnapshot(c *cli.Context) {
+	client := connect(c)
+	log.Infof("Taking snapshot to %s", c.String("file"))
+	snap, err := cesw.WriteSnapshot(client, c.String("file"), encryptionFromFlags(c))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d definitions, %d catalog nodes, %d checks and %d watchers saved.\n", len(snap.Services), len(snap.Catalog), len(snap.Checks), len(snap.Watchers))
+}
+
+func runRestoreSnapshot(c *cli.Context) {
+	snap, err := cesw.ReadSnapshot(c.String("file"), encryptionFromFlags(c))
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := connect(c)
+	log.Infof("Restoring snapshot taken at %s", snap.Taken.Format("2006-01-02 15:04:05"))
+	summary, err := cesw.RestoreSnapshot(client, snap, c.Bool("rebuild"))
+	fmt.Printf("%d definitions, %d catalog services and %d checks restored.\n", len(summary.Definitions), len(summary.Services), len(summary.Checks))
+	for _, e := range summary.Invalid {
+		fmt.Printf("  skipped invalid %s: %v\n", e.Key, e.Err)
+	}
+	for _, e := range summary.Failed {
+		fmt.Printf("  failed %s: %v\n", e.Key, e.Err)
+	}
+	for _, w := range snap.Watchers {
+		fmt.Printf("  %s was watched from %s\n", w.Node, w.Holder)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/armon/consul-api"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"github.com/nsf/termbox-go"
+	"time"
+)
+
+//topSnapshot is what the top command displays.
+type topSnapshot struct {
+	statuses []*cesw.ExternalServiceStatus
+	leaders  map[string]string
+	err      error
+	taken    time.Time
+}
+
+//topUI holds the state of the top command screen. The selected service is
+//kept by name as well as by position, so it stays selected when snapshots
+//add or remove services before it.
+type topUI struct {
+	client         *cesw.Client
+	node           string
+	snap           *topSnapshot
+	selected       int
+	selNode        string
+	selService     string
+	offset         int
+	message        string
+	confirmNode    string
+	confirmService string
+}
+
+var stateColors = map[string]termbox.Attribute{
+	"passing":                termbox.ColorGreen,
+	"warning":                termbox.ColorYellow,
+	"critical":               termbox.ColorRed,
+	"running":                termbox.ColorGreen,
+	"stopped":                termbox.ColorYellow,
+	"deleted":                termbox.ColorRed,
+	cesw.CatalogRegistered:   termbox.ColorGreen,
+	cesw.CatalogDeregistered: termbox.ColorYellow,
+}
+
+func takeSnapshot(client *cesw.Client, node string) *topSnapshot {
+	snap := &topSnapshot{leaders: make(map[string]string), taken: time.Now()}
+	snap.statuses, snap.err = cesw.ExternalServicesStatus(client, node, 0)
+	for _, st := range snap.statuses {
+		if _, ok := snap.leaders[st.Node]; ok {
+			continue
+		}
+		leader, err := cesw.WatcherLeader(client, st.Node)
+		if err != nil {
+			snap.err = err
+		}
+		snap.leaders[st.Node] = leader
+	}
+	return snap
+}
+
+//blockOn calls notify every time the result of query changes.
+func blockOn(query func(*consulapi.QueryOptions) (*consulapi.QueryMeta, error), notify chan<- struct{}) {
+	var index uint64
+	for {
+		qm, err := query(&consulapi.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute})
+		if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		if qm.LastIndex != index {
+			index = qm.LastIndex
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+//watchSnapshots sends a new snapshot every time the definitions, the checks
+//or the catalog change.
+func watchSnapshots(client *cesw.Client, node string, snaps chan<- *topSnapshot) {
+	changed := make(chan struct{}, 1)
+	go blockOn(func(q *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		_, qm, err := client.KV().List("ExternalServices/", q)
+		return qm, err
+	}, changed)
+	go blockOn(func(q *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		_, qm, err := client.Health().State("any", q)
+		return qm, err
+	}, changed)
+	go blockOn(func(q *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		_, qm, err := client.Catalog().Services(q)
+		return qm, err
+	}, changed)
+	for range changed {
+		snaps <- takeSnapshot(client, node)
+	}
+}
+
+func printAt(x, y int, s string, fg, bg termbox.Attribute) int {
+	for _, r := range s {
+		termbox.SetCell(x, y, r, fg, bg)
+		x++
+	}
+	return x
+}
+
+func (ui *topUI) draw() {
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+	width, height := termbox.Size()
+	printAt(0, 0, "consul-externalservice top", termbox.AttrBold, termbox.ColorDefault)
+	if ui.snap == nil {
+		printAt(0, 2, "Loading ...", termbox.ColorDefault, termbox.ColorDefault)
+		termbox.Flush()
+		return
+	}
+	printAt(width-20, 0, ui.snap.taken.Format("2006-01-02 15:04:05"), termbox.ColorDefault, termbox.ColorDefault)
+	printAt(0, 1, fmt.Sprintf("%-24s %-10s %-14s %-10s", "SERVICE", "DESIRED", "CATALOG", "CHECK"), termbox.AttrBold, termbox.ColorDefault)
+
+	//Lines are node headers, with status -1, followed by their services.
+	type line struct {
+		node   string
+		status int
+	}
+	var lines []line
+	selectedLine := 0
+	for i, st := range ui.snap.statuses {
+		if i == 0 || st.Node != ui.snap.statuses[i-1].Node {
+			lines = append(lines, line{node: st.Node, status: -1})
+		}
+		if i == ui.selected {
+			selectedLine = len(lines)
+		}
+		lines = append(lines, line{node: st.Node, status: i})
+	}
+
+	//Scroll so the selected service, and its node header when possible, is
+	//visible between the column titles and the status line.
+	rows := height - 3
+	if rows < 1 {
+		rows = 1
+	}
+	if selectedLine-1 < ui.offset {
+		ui.offset = selectedLine - 1
+	}
+	if selectedLine >= ui.offset+rows {
+		ui.offset = selectedLine - rows + 1
+	}
+	if ui.offset > len(lines)-rows {
+		ui.offset = len(lines) - rows
+	}
+	if ui.offset < 0 {
+		ui.offset = 0
+	}
+
+	for y, l := range lines[ui.offset:] {
+		y += 2
+		if y >= height-1 {
+			break
+		}
+		if l.status < 0 {
+			leader := ui.snap.leaders[l.node]
+			if leader == "" {
+				leader = "no watcher"
+			}
+			x := printAt(0, y, l.node, termbox.AttrBold|termbox.ColorBlue, termbox.ColorDefault)
+			printAt(x+1, y, "(leader: "+leader+")", termbox.ColorDefault, termbox.ColorDefault)
+			continue
+		}
+		i, st := l.status, ui.snap.statuses[l.status]
+		bg := termbox.ColorDefault
+		if i == ui.selected {
+			bg = termbox.ColorBlack
+		}
+		catalog := cesw.CatalogDeregistered
+		if st.Registered {
+			catalog = cesw.CatalogRegistered
+		}
+		x := printAt(0, y, fmt.Sprintf("  %-22s ", st.Service), termbox.ColorDefault, bg)
+		x = printAt(x, y, fmt.Sprintf("%-10s ", st.Definition.TargetState), stateColors[st.Definition.TargetState], bg)
+		x = printAt(x, y, fmt.Sprintf("%-14s ", catalog), stateColors[catalog], bg)
+		printAt(x, y, fmt.Sprintf("%-10s", st.CheckStatus), stateColors[st.CheckStatus], bg)
+	}
+
+	status := "up/down: select  e: enable  d: disable  x: delete  q: quit"
+	if ui.snap.err != nil {
+		status = "error: " + ui.snap.err.Error()
+	}
+	if ui.message != "" {
+		status = ui.message
+	}
+	printAt(0, height-1, status, termbox.AttrReverse, termbox.ColorDefault)
+	termbox.Flush()
+}
+
+//selectAt selects the service at index i of the current snapshot.
+func (ui *topUI) selectAt(i int) {
+	ui.selected = i
+	ui.selNode, ui.selService = "", ""
+	if ui.snap != nil && i < len(ui.snap.statuses) {
+		ui.selNode, ui.selService = ui.snap.statuses[i].Node, ui.snap.statuses[i].Service
+	}
+}
+
+//setSnapshot displays snap, keeping the selected service selected if it is
+//still there and the same position otherwise.
+func (ui *topUI) setSnapshot(snap *topSnapshot) {
+	ui.snap = snap
+	for i, st := range snap.statuses {
+		if st.Node == ui.selNode && st.Service == ui.selService {
+			ui.selected = i
+			return
+		}
+	}
+	i := ui.selected
+	if i >= len(snap.statuses) {
+		i = len(snap.statuses) - 1
+	}
+	if i < 0 {
+		i = 0
+	}
+	ui.selectAt(i)
+}
+
+//setState sets the target state of the service of node.
+func (ui *topUI) setState(node, service, state string) {
+	if service == "" {
+		return
+	}
+	if _, err := cesw.SetExternalServiceTargetState(ui.client, service, node, state); err != nil {
+		ui.message = fmt.Sprintf("error setting %s/%s %s: %v", node, service, state, err)
+		return
+	}
+	ui.message = fmt.Sprintf("%s/%s set to %s", node, service, state)
+}
+
+//handleKey processes a key press and reports whether to quit.
+func (ui *topUI) handleKey(ev termbox.Event) bool {
+	if ui.confirmService != "" {
+		node, service := ui.confirmNode, ui.confirmService
+		ui.confirmNode, ui.confirmService = "", ""
+		ui.message = ""
+		if ev.Ch == 'y' {
+			ui.setState(node, service, "deleted")
+		}
+		return false
+	}
+	ui.message = ""
+	count := 0
+	if ui.snap != nil {
+		count = len(ui.snap.statuses)
+	}
+	switch {
+	case ev.Key == termbox.KeyEsc || ev.Key == termbox.KeyCtrlC || ev.Ch == 'q':
+		return true
+	case ev.Key == termbox.KeyArrowUp || ev.Ch == 'k':
+		if ui.selected > 0 {
+			ui.selectAt(ui.selected - 1)
+		}
+	case ev.Key == termbox.KeyArrowDown || ev.Ch == 'j':
+		if ui.selected < count-1 {
+			ui.selectAt(ui.selected + 1)
+		}
+	case ev.Ch == 'e':
+		ui.setState(ui.selNode, ui.selService, "running")
+	case ev.Ch == 'd':
+		ui.setState(ui.selNode, ui.selService, "stopped")
+	case ev.Ch == 'x':
+		if ui.selService != "" {
+			//The prompt names the service, so that is the one deleted on y
+			//whatever snapshots arrive meanwhile.
+			ui.confirmNode, ui.confirmService = ui.selNode, ui.selService
+			ui.message = fmt.Sprintf("delete %s/%s? (y/n)", ui.selNode, ui.selService)
+		}
+	}
+	return false
+}
+
+func runTop(c *cli.Context) {
+	ui := &topUI{client: connect(c), node: c.String("node")}
+	if err := termbox.Init(); err != nil {
+		log.Fatal(err)
+	}
+	defer termbox.Close()
+
+	snaps := make(chan *topSnapshot)
+	go watchSnapshots(ui.client, ui.node, snaps)
+	events := make(chan termbox.Event)
+	go func() {
+		for {
+			events <- termbox.PollEvent()
+		}
+	}()
+
+	ui.draw()
+	for {
+		select {
+		case snap := <-snaps:
+			ui.setSnapshot(snap)
+		case ev := <-events:
+			if ev.Type == termbox.EventKey && ui.handleKey(ev) {
+				return
+			}
+			if ev.Type == termbox.EventError {
+				return
+			}
+		}
+		ui.draw()
+	}
+}
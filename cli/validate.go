@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"os"
+)
+
+func runValidate(c *cli.Context) {
+	problems, err := cesw.ValidateDefinitionsFile(c.String("file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problems found.\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid.\n", c.String("file"))
+}
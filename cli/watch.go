@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/armon/consul-api"
+	"github.com/codegangsta/cli"
+	cesw "github.com/jmcarbo/consul-externalservice"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+//watchEvent is a change seen by the watch command.
+type watchEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Node    string    `json:"node"`
+	Service string    `json:"service"`
+	Old     string    `json:"old,omitempty"`
+	New     string    `json:"new,omitempty"`
+	Changes []string  `json:"changes,omitempty"`
+}
+
+func (e *watchEvent) String() string {
+	s := fmt.Sprintf("%s %s/%s %s", e.Time.Format(time.RFC3339), e.Node, e.Service, e.Type)
+	if e.Old != "" || e.New != "" {
+		s += fmt.Sprintf(": %s -> %s", orNone(e.Old), orNone(e.New))
+	}
+	if len(e.Changes) > 0 {
+		s += ": " + strings.Join(e.Changes, ", ")
+	}
+	return s
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+//streamWatcher follows the definitions, checks and catalog registrations of
+//the external services with blocking queries and sends every change to
+//events. The first result of every query is only used as baseline.
+type streamWatcher struct {
+	client *cesw.Client
+	node   string
+	events chan *watchEvent
+	nlock  sync.Mutex
+	nodes  map[string]bool
+}
+
+func (w *streamWatcher) emit(typ, node, service, old, new string, changes []string) {
+	w.events <- &watchEvent{Time: time.Now(), Type: typ, Node: node, Service: service, Old: old, New: new, Changes: changes}
+}
+
+//block runs query with blocking semantics forever, retrying after errors.
+func (w *streamWatcher) block(what string, query func(*consulapi.QueryOptions) (*consulapi.QueryMeta, error)) {
+	var index uint64
+	for {
+		qm, err := query(&consulapi.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute})
+		if err != nil {
+			log.WithFields(log.Fields{"watch": what, "error": err}).Error("blocking query failed, retrying")
+			time.Sleep(time.Second)
+			continue
+		}
+		index = qm.LastIndex
+	}
+}
+
+func (w *streamWatcher) watchDefinitions() {
+	prefix := "ExternalServices/"
+	if w.node != "" {
+		prefix += w.node + "/"
+	}
+	var known map[string]*cesw.ExternalServiceDefinition
+	w.block("definitions", func(q *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		kvp, qm, err := w.client.KV().List(prefix, q)
+		if err != nil {
+			return nil, err
+		}
+		current := make(map[string]*cesw.ExternalServiceDefinition)
+		for _, a := range kvp {
+			var esd cesw.ExternalServiceDefinition
+			if err := json.Unmarshal(a.Value, &esd); err != nil {
+				continue
+			}
+			current[a.Key] = &esd
+			parts := strings.Split(a.Key, "/")
+			if len(parts) == 3 {
+				w.followNode(parts[1])
+			}
+		}
+		if known != nil {
+			for key, esd := range current {
+				parts := strings.Split(key, "/")
+				if len(parts) != 3 {
+					continue
+				}
+				old, ok := known[key]
+				if !ok {
+					w.emit("definition added", parts[1], parts[2], "", esd.TargetState, nil)
+					continue
+				}
+				var changes []string
+				for _, d := range cesw.DiffDefinitions(old, esd) {
+					if d.Field == "targetstate" {
+						w.emit("target state", parts[1], parts[2], old.TargetState, esd.TargetState, nil)
+					} else {
+						changes = append(changes, d.String())
+					}
+				}
+				if len(changes) > 0 {
+					w.emit("definition changed", parts[1], parts[2], "", "", changes)
+				}
+			}
+			for key := range known {
+				parts := strings.Split(key, "/")
+				if _, ok := current[key]; !ok && len(parts) == 3 {
+					w.emit("definition removed", parts[1], parts[2], "", "", nil)
+				}
+			}
+		}
+		known = current
+		return qm, nil
+	})
+}
+
+func (w *streamWatcher) watchHealth() {
+	var known map[string]string
+	w.block("health", func(q *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		checks, qm, err := w.client.Health().State("any", q)
+		if err != nil {
+			return nil, err
+		}
+		current := make(map[string]string)
+		for _, c := range checks {
+			parts := strings.Split(c.Name, ":")
+			if len(parts) != 3 || parts[0] != "check" || (w.node != "" && parts[2] != w.node) {
+				continue
+			}
+			current[c.Name] = c.Status
+		}
+		if known != nil {
+			for name, status := range current {
+				if known[name] != status {
+					parts := strings.Split(name, ":")
+					w.emit("health", parts[2], parts[1], known[name], status, nil)
+				}
+			}
+			for name, status := range known {
+				if _, ok := current[name]; !ok {
+					parts := strings.Split(name, ":")
+					w.emit("health", parts[2], parts[1], status, "", nil)
+				}
+			}
+		}
+		known = current
+		return qm, nil
+	})
+}
+
+//followNode starts watching the catalog registrations of node the first
+//time it is seen.
+func (w *streamWatcher) followNode(node string) {
+	w.nlock.Lock()
+	defer w.nlock.Unlock()
+	if w.nodes[node] {
+		return
+	}
+	w.nodes[node] = true
+	go w.watchCatalog(node)
+}
+
+func (w *streamWatcher) watchCatalog(node string) {
+	var known map[string]bool
+	w.block("catalog "+node, func(q *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		cn, qm, err := w.client.Catalog().Node(node, q)
+		if err != nil {
+			return nil, err
+		}
+		current := make(map[string]bool)
+		if cn != nil {
+			for id := range cn.Services {
+				current[id] = true
+			}
+		}
+		if known != nil {
+			for id := range current {
+				if !known[id] {
+					w.emit("catalog", node, id, cesw.CatalogDeregistered, cesw.CatalogRegistered, nil)
+				}
+			}
+			for id := range known {
+				if !current[id] {
+					w.emit("catalog", node, id, cesw.CatalogRegistered, cesw.CatalogDeregistered, nil)
+				}
+			}
+		}
+		known = current
+		return qm, nil
+	})
+}
+
+func runWatch(c *cli.Context) {
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		log.Fatalf("unknown format %q, expected text or json", format)
+	}
+	w := &streamWatcher{client: connect(c), node: c.String("node"), events: make(chan *watchEvent), nodes: make(map[string]bool)}
+	if w.node != "" {
+		w.followNode(w.node)
+	}
+	go w.watchDefinitions()
+	go w.watchHealth()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt)
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case e := <-w.events:
+			if format == "json" {
+				enc.Encode(e)
+			} else {
+				fmt.Println(e)
+			}
+		case <-signalCh:
+			return
+		}
+	}
+}
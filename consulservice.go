@@ -0,0 +1,290 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//FromConsulService is the source of files holding consul agent service
+//definitions, {"service": {..., "check": {...}}} or {"services": [...]}, in
+//JSON or HCL.
+const FromConsulService = "consul-service"
+
+//UnmappedField is a field of a consul service definition that has no
+//equivalent in external service definitions and is left out of the
+//conversion.
+type UnmappedField struct {
+	Service string
+	Field   string
+}
+
+func (u UnmappedField) String() string {
+	if u.Service == "" {
+		return u.Field
+	}
+	return u.Service + ": " + u.Field
+}
+
+//ConvertConsulServices converts the consul agent service definitions of data
+//into definitions of node. JSON files are read as JSON and any other format
+//as HCL. Services get the address, port and tags of their definition and
+//are stopped. Services without address are an error, as consul defaults it
+//to the agent address which external services do not have. Their first check
+//becomes the check of the service: script and args checks run their command,
+//ttl checks stay ttl checks, http checks run curl and tcp checks run nc.
+//Every other field is returned as unmapped.
+func ConvertConsulServices(data []byte, format, node string) (*ExportFile, []UnmappedField, error) {
+	if err := ValidateName("node", node); err != nil {
+		return nil, nil, fmt.Errorf("converting consul services: %v", err)
+	}
+	var top map[string]interface{}
+	if format == FormatJSON {
+		if err := json.Unmarshal(data, &top); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		if top, err = decodeHCLConsulServices(data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ex := &ExportFile{Version: ExportVersion}
+	var unmapped []UnmappedField
+	for _, k := range sortedKeys(top) {
+		switch consulFieldName(k) {
+		case "service", "services":
+			for _, s := range consulObjects(top[k]) {
+				es, u, err := convertConsulService(s, node)
+				if err != nil {
+					return nil, nil, err
+				}
+				ex.Services = append(ex.Services, es)
+				unmapped = append(unmapped, u...)
+			}
+		default:
+			unmapped = append(unmapped, UnmappedField{Field: k})
+		}
+	}
+	if len(ex.Services) == 0 {
+		return nil, nil, fmt.Errorf("no consul service definitions found")
+	}
+	return ex, unmapped, nil
+}
+
+//decodeHCLConsulServices decodes the service and services entries of an HCL
+//file, every one on its own for the reason given in decodeHCLServices.
+func decodeHCLConsulServices(data []byte) (map[string]interface{}, error) {
+	f, err := hcl.Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	list, ok := f.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("expected service blocks")
+	}
+	top := make(map[string]interface{})
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 {
+			continue
+		}
+		key := item.Keys[0].Token.Value().(string)
+		var v interface{}
+		if err := hcl.DecodeObject(&v, item.Val); err != nil {
+			return nil, err
+		}
+		l, _ := top[key].([]interface{})
+		top[key] = append(l, v)
+	}
+	return top, nil
+}
+
+//consulObjects returns the objects of v, a single object or a list of them
+//as decoded from JSON or HCL.
+func consulObjects(v interface{}) []map[string]interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []map[string]interface{}:
+		return v
+	case []interface{}:
+		var objects []map[string]interface{}
+		for _, e := range v {
+			objects = append(objects, consulObjects(e)...)
+		}
+		return objects
+	}
+	return nil
+}
+
+//consulFieldName folds the snake_case and CamelCase spellings consul accepts
+//for the same field.
+func consulFieldName(k string) string {
+	return strings.ToLower(strings.Replace(k, "_", "", -1))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func convertConsulService(s map[string]interface{}, node string) (*ExportedService, []UnmappedField, error) {
+	var name, id string
+	for k, v := range s {
+		switch consulFieldName(k) {
+		case "name":
+			name = fmt.Sprint(v)
+		case "id":
+			id = fmt.Sprint(v)
+		}
+	}
+	if name == "" {
+		return nil, nil, fmt.Errorf("consul service definition without name")
+	}
+	if err := ValidateName("service", name); err != nil {
+		return nil, nil, err
+	}
+
+	es := &ExportedService{Node: node, Service: name}
+	d := &es.Definition
+	d.TargetState = "stopped"
+	var unmapped []UnmappedField
+	unmap := func(field string) {
+		unmapped = append(unmapped, UnmappedField{Service: name, Field: field})
+	}
+	var checks []map[string]interface{}
+	for _, k := range sortedKeys(s) {
+		v := s[k]
+		switch consulFieldName(k) {
+		case "name":
+		case "id":
+			//The name of an external service is its id too.
+			if id != name {
+				unmap(k)
+			}
+		case "address":
+			d.Address = fmt.Sprint(v)
+		case "port":
+			port, err := consulInt(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("service %s: port: %v", name, err)
+			}
+			d.Port = port
+		case "tags":
+			for _, t := range consulValues(v) {
+				d.Tags = append(d.Tags, fmt.Sprint(t))
+			}
+		case "check", "checks":
+			checks = append(checks, consulObjects(v)...)
+		default:
+			unmap(k)
+		}
+	}
+
+	if d.Address == "" {
+		return nil, nil, fmt.Errorf("service %s has no address, which an external service requires as there is no agent to default it to: set \"address\" in its definition", name)
+	}
+
+	d.Interval = "10s"
+	for i, c := range checks {
+		if i > 0 {
+			unmap(fmt.Sprintf("checks[%d]", i))
+			continue
+		}
+		for _, f := range convertConsulCheck(c, d) {
+			unmap("check." + f)
+		}
+	}
+	return es, unmapped, nil
+}
+
+//convertConsulCheck sets the check of d from a consul check definition and
+//returns the fields it cannot map.
+func convertConsulCheck(c map[string]interface{}, d *ExternalServiceDefinition) []string {
+	var unmapped []string
+	for _, k := range sortedKeys(c) {
+		v := c[k]
+		switch consulFieldName(k) {
+		case "script":
+			d.Command = fmt.Sprint(v)
+		case "args":
+			var args []string
+			for _, a := range consulValues(v) {
+				args = append(args, shellQuote(fmt.Sprint(a)))
+			}
+			d.Command = strings.Join(args, " ")
+		case "http":
+			d.Command = "curl -fsS -o /dev/null " + shellQuote(fmt.Sprint(v))
+		case "tcp":
+			host, port, err := net.SplitHostPort(fmt.Sprint(v))
+			if err != nil {
+				unmapped = append(unmapped, k)
+				continue
+			}
+			d.Command = "nc -z " + shellQuote(host) + " " + shellQuote(port)
+		case "ttl":
+			d.CheckType = CheckTTL
+			d.Interval = fmt.Sprint(v)
+		case "interval":
+			if d.CheckType != CheckTTL {
+				d.Interval = fmt.Sprint(v)
+			}
+		default:
+			unmapped = append(unmapped, k)
+		}
+	}
+	if d.CheckType == CheckTTL {
+		d.Command = ""
+	}
+	return unmapped
+}
+
+//consulValues returns the elements of a list, or v alone.
+func consulValues(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		return v
+	case []string:
+		var l []interface{}
+		for _, s := range v {
+			l = append(l, s)
+		}
+		return l
+	}
+	return []interface{}{v}
+}
+
+func consulInt(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, fmt.Errorf("%v is not an integer", v)
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./:=@%+,-]+$`)
+
+//shellQuote quotes s for the shell running check commands, if needed.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
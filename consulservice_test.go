@@ -0,0 +1,69 @@
+package consul_externalservice
+
+import (
+	. "github.com/franela/goblin"
+	"strings"
+	"testing"
+)
+
+func TestConsulServices(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("consul service definitions", func() {
+		g.It("convert from JSON and report unmapped fields", func() {
+			data := []byte(`{"service": {"name": "web", "id": "web1", "address": "10.0.0.5", "port": 8080, "tags": ["http"], "meta": {"team": "ops"},
+  "check": {"http": "http://10.0.0.5:8080/health", "interval": "15s", "timeout": "1s"}}}`)
+			ex, unmapped, err := ConvertConsulServices(data, FormatJSON, "ext1")
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(ex.Services)).Equal(1)
+			es := ex.Services[0]
+			g.Assert(es.Node).Equal("ext1")
+			g.Assert(es.Service).Equal("web")
+			g.Assert(es.Definition.Port).Equal(8080)
+			g.Assert(es.Definition.Command).Equal("curl -fsS -o /dev/null http://10.0.0.5:8080/health")
+			g.Assert(es.Definition.Interval).Equal("15s")
+			g.Assert(es.Definition.Validate() == nil).IsTrue()
+			var fields []string
+			for _, u := range unmapped {
+				fields = append(fields, u.String())
+			}
+			g.Assert(fields).Equal([]string{"web: id", "web: meta", "web: check.timeout"})
+		})
+
+		g.It("convert from HCL", func() {
+			data := []byte(`
+service {
+  name    = "db"
+  address = "10.0.0.6"
+  port    = 5432
+  check {
+    args     = ["pg_isready", "-d", "my db"]
+    interval = "5s"
+  }
+}
+
+service {
+  name    = "queue"
+  address = "10.0.0.7"
+  checks  = [{ ttl = "30s" }, { tcp = "10.0.0.7:5672", interval = "3s" }]
+}
+`)
+			ex, unmapped, err := ConvertConsulServices(data, FormatHCL, "ext1")
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(ex.Services)).Equal(2)
+			g.Assert(ex.Services[0].Definition.Command).Equal("pg_isready -d 'my db'")
+			g.Assert(ex.Services[1].Definition.CheckType).Equal(CheckTTL)
+			g.Assert(ex.Services[1].Definition.Interval).Equal("30s")
+			g.Assert(len(unmapped)).Equal(1)
+			g.Assert(unmapped[0].String()).Equal("queue: checks[1]")
+		})
+
+		g.It("need a node, service names and addresses", func() {
+			_, _, err := ConvertConsulServices([]byte(`{"service": {"name": "web"}}`), FormatJSON, "")
+			g.Assert(err != nil).IsTrue()
+			_, _, err = ConvertConsulServices([]byte(`{"service": {"port": 80}}`), FormatJSON, "ext1")
+			g.Assert(err != nil).IsTrue()
+			_, _, err = ConvertConsulServices([]byte(`{"service": {"name": "web", "port": 80}}`), FormatJSON, "ext1")
+			g.Assert(strings.Contains(err.Error(), `set "address"`)).IsTrue()
+		})
+	})
+}
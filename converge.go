@@ -0,0 +1,83 @@
+package consul_externalservice
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//Converged reports whether the watcher of the node of es has brought the
+//catalog and the check of es in line with its TargetState. A running
+//service has converged once its check exists and it is registered if, and
+//only if, the check is passing. A stopped service has neither check nor
+//catalog registration, and a deleted one has no definition either.
+func (es *ExternalService) Converged() (bool, error) {
+	checks, _, err := es.client.Health().State("any", nil)
+	if err != nil {
+		return false, err
+	}
+	checkName := fmt.Sprintf("check:%s:%s", es.service, es.node)
+	status := ""
+	for _, c := range checks {
+		if c.Name == checkName {
+			status = c.Status
+		}
+	}
+	cn, _, err := es.client.Catalog().Node(es.node, nil)
+	if err != nil {
+		return false, err
+	}
+	registered := cn != nil && cn.Services[es.service] != nil
+
+	switch es.definition.TargetState {
+	case "running":
+		switch status {
+		case "passing":
+			return registered, nil
+		case "critical":
+			return !registered, nil
+		}
+		return status != "", nil
+	case "stopped":
+		return status == "" && !registered, nil
+	case "deleted":
+		exists, err := ExternalServiceExists(es.client, es.service, es.node)
+		if err != nil {
+			return false, err
+		}
+		return !exists && status == "" && !registered, nil
+	}
+	return false, fmt.Errorf("unknown target state %q", es.definition.TargetState)
+}
+
+//WaitConverged polls every second until all services have converged or
+//timeout expires, in which case it returns an error naming the services
+//that have not converged yet.
+func WaitConverged(services []*ExternalService, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	pending := services
+	for {
+		var left []*ExternalService
+		for _, es := range pending {
+			ok, err := es.Converged()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				left = append(left, es)
+			}
+		}
+		if len(left) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			var names []string
+			for _, es := range left {
+				names = append(names, es.node+"/"+es.service)
+			}
+			return fmt.Errorf("timeout waiting for %s", strings.Join(names, ", "))
+		}
+		pending = left
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,50 @@
+package consul_externalservice
+
+import (
+	"fmt"
+	"strings"
+)
+
+//FieldDiff is a field whose value differs between two definitions.
+type FieldDiff struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (d FieldDiff) String() string {
+	return fmt.Sprintf("%s: %s -> %s", d.Field, d.Old, d.New)
+}
+
+//DiffDefinitions returns the fields that differ from a to b. A nil
+//definition is treated as an empty one.
+func DiffDefinitions(a, b *ExternalServiceDefinition) []FieldDiff {
+	if a == nil {
+		a = &ExternalServiceDefinition{}
+	}
+	if b == nil {
+		b = &ExternalServiceDefinition{}
+	}
+	var diffs []FieldDiff
+	add := func(field, old, new string) {
+		if old != new {
+			diffs = append(diffs, FieldDiff{Field: field, Old: old, New: new})
+		}
+	}
+	add("address", fmt.Sprintf("%q", a.Address), fmt.Sprintf("%q", b.Address))
+	add("port", fmt.Sprint(a.Port), fmt.Sprint(b.Port))
+	add("command", fmt.Sprintf("%q", a.Command), fmt.Sprintf("%q", b.Command))
+	add("checktype", fmt.Sprintf("%q", checkType(a)), fmt.Sprintf("%q", checkType(b)))
+	add("interval", fmt.Sprintf("%q", a.Interval), fmt.Sprintf("%q", b.Interval))
+	add("targetstate", fmt.Sprintf("%q", a.TargetState), fmt.Sprintf("%q", b.TargetState))
+	add("tags", "["+strings.Join(a.Tags, ", ")+"]", "["+strings.Join(b.Tags, ", ")+"]")
+	add("state", fmt.Sprintf("%q", a.State), fmt.Sprintf("%q", b.State))
+	return diffs
+}
+
+func checkType(esd *ExternalServiceDefinition) string {
+	if esd.CheckType == "" {
+		return CheckScript
+	}
+	return esd.CheckType
+}
@@ -0,0 +1,26 @@
+package consul_externalservice
+
+import (
+	. "github.com/franela/goblin"
+	"testing"
+)
+
+func TestDiffDefinitions(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("definition diff", func() {
+		g.It("is empty for equivalent definitions", func() {
+			a := &ExternalServiceDefinition{Address: "localhost", Port: 80, Interval: "1s", TargetState: "running"}
+			b := &ExternalServiceDefinition{Address: "localhost", Port: 80, Interval: "1s", TargetState: "running", CheckType: CheckScript, Tags: []string{}}
+			g.Assert(len(DiffDefinitions(a, b))).Equal(0)
+		})
+
+		g.It("lists the changed fields", func() {
+			a := &ExternalServiceDefinition{Address: "localhost", Port: 80, Interval: "1s", TargetState: "running"}
+			b := &ExternalServiceDefinition{Address: "localhost", Port: 81, Interval: "1s", TargetState: "stopped"}
+			diffs := DiffDefinitions(a, b)
+			g.Assert(len(diffs)).Equal(2)
+			g.Assert(diffs[0]).Equal(FieldDiff{Field: "port", Old: "80", New: "81"})
+			g.Assert(diffs[1].Field).Equal("targetstate")
+		})
+	})
+}
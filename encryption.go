@@ -0,0 +1,159 @@
+package consul_externalservice
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+)
+
+//Encrypted backups start with encryptedMagic and a byte telling how the key
+//is obtained, followed by the scrypt salt, the AES-GCM nonce and the sealed
+//data. The header is authenticated together with the data.
+const (
+	encryptedMagic  = "CESENC1"
+	keyFromPassword = 'p'
+	keyFromKeyFile  = 'k'
+	saltSize        = 16
+	encryptedHeader = len(encryptedMagic) + 1 + saltSize
+	scryptN         = 32768
+	scryptR         = 8
+)
+
+//EncryptedSuffix is appended to the name of encrypted scheduled backups and
+//ignored when choosing the format of a file from its extension.
+const EncryptedSuffix = ".enc"
+
+//ErrDecrypt is returned when a backup cannot be decrypted with the
+//passphrase or key file given.
+var ErrDecrypt = errors.New("cannot decrypt backup: wrong passphrase or key file, or the file is corrupted")
+
+//ErrEncrypted is returned when reading an encrypted backup without a
+//passphrase or key file.
+var ErrEncrypted = errors.New("backup is encrypted, a passphrase or key file is required")
+
+//Encryption holds the secret backups are encrypted with, either a
+//passphrase or the name of a key file. The key of a key file is derived from
+//its whole content with scrypt and a random salt, like passphrases, so any
+//file of random data can be used and short ones are not easier to guess.
+type Encryption struct {
+	Passphrase string
+	KeyFile    string
+}
+
+//IsEncrypted reports whether data is an encrypted backup.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+func (e *Encryption) key(kind byte, salt []byte) ([]byte, error) {
+	switch kind {
+	case keyFromPassword:
+		if e.Passphrase == "" {
+			return nil, fmt.Errorf("backup is encrypted with a passphrase")
+		}
+		return scrypt.Key([]byte(e.Passphrase), salt, scryptN, scryptR, 1, 32)
+	case keyFromKeyFile:
+		if e.KeyFile == "" {
+			return nil, fmt.Errorf("backup is encrypted with a key file")
+		}
+		data, err := ioutil.ReadFile(e.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", e.KeyFile)
+		}
+		return scrypt.Key(bytes.TrimSpace(data), salt, scryptN, scryptR, 1, 32)
+	}
+	return nil, fmt.Errorf("unknown key kind %q", kind)
+}
+
+func (e *Encryption) kind() (byte, error) {
+	switch {
+	case e.Passphrase != "" && e.KeyFile != "":
+		return 0, fmt.Errorf("use either a passphrase or a key file, not both")
+	case e.Passphrase != "":
+		return keyFromPassword, nil
+	case e.KeyFile != "":
+		return keyFromKeyFile, nil
+	}
+	return 0, fmt.Errorf("a passphrase or key file is required")
+}
+
+//Encrypt seals data with AES-256-GCM.
+func (e *Encryption) Encrypt(data []byte) ([]byte, error) {
+	kind, err := e.kind()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptedHeader)
+	copy(header, encryptedMagic)
+	header[len(encryptedMagic)] = kind
+	salt := header[len(encryptedMagic)+1:]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	gcm, err := e.gcm(kind, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
+
+//Decrypt opens data sealed by Encrypt. It returns ErrDecrypt if the
+//passphrase or key file is not the one data was encrypted with.
+func (e *Encryption) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) || len(data) < encryptedHeader {
+		return nil, fmt.Errorf("not an encrypted backup")
+	}
+	header := data[:encryptedHeader]
+	kind, salt := header[len(encryptedMagic)], header[len(encryptedMagic)+1:]
+	gcm, err := e.gcm(kind, salt)
+	if err != nil {
+		return nil, err
+	}
+	rest := data[encryptedHeader:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func (e *Encryption) gcm(kind byte, salt []byte) (cipher.AEAD, error) {
+	key, err := e.key(kind, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//decryptBackup returns the plain content of a backup file, decrypting it
+//with enc if it is encrypted.
+func decryptBackup(data []byte, enc *Encryption) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if enc == nil {
+		return nil, ErrEncrypted
+	}
+	return enc.Decrypt(data)
+}
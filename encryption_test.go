@@ -0,0 +1,48 @@
+package consul_externalservice
+
+import (
+	. "github.com/franela/goblin"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("backup encryption", func() {
+		data := []byte("version: 2\nservices: []\n")
+
+		g.It("round trips with a passphrase", func() {
+			sealed, err := (&Encryption{Passphrase: "secret"}).Encrypt(data)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(IsEncrypted(sealed)).IsTrue()
+			plain, err := (&Encryption{Passphrase: "secret"}).Decrypt(sealed)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(string(plain)).Equal(string(data))
+		})
+
+		g.It("fails clearly with the wrong passphrase", func() {
+			sealed, _ := (&Encryption{Passphrase: "secret"}).Encrypt(data)
+			_, err := (&Encryption{Passphrase: "guess"}).Decrypt(sealed)
+			g.Assert(err).Equal(ErrDecrypt)
+			_, err = decryptBackup(sealed, nil)
+			g.Assert(err).Equal(ErrEncrypted)
+		})
+
+		g.It("round trips with a key file", func() {
+			f, _ := ioutil.TempFile("", "key")
+			f.WriteString("c2VjcmV0IGtleSBmaWxlIGNvbnRlbnQ=\n")
+			f.Close()
+			defer os.Remove(f.Name())
+			enc := &Encryption{KeyFile: f.Name()}
+			sealed, err := enc.Encrypt(data)
+			g.Assert(err == nil).IsTrue()
+			plain, err := enc.Decrypt(sealed)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(string(plain)).Equal(string(data))
+			sealed[len(sealed)-1] ^= 1
+			_, err = enc.Decrypt(sealed)
+			g.Assert(err).Equal(ErrDecrypt)
+		})
+	})
+}
@@ -0,0 +1,36 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	consulapi "github.com/armon/consul-api"
+)
+
+//Catalog states of an external service reported in a TransitionEvent.
+const (
+	CatalogRegistered   = "registered"
+	CatalogDeregistered = "deregistered"
+)
+
+//DefaultTransitionEvent is the name suggested for the consul user events
+//fired by the watchers.
+const DefaultTransitionEvent = "externalservice-transition"
+
+//TransitionEvent is the payload of the consul user event fired by a watcher
+//every time it registers or deregisters a service in the catalog.
+type TransitionEvent struct {
+	Node    string `json:"node"`
+	Service string `json:"service"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+//FireTransitionEvent fires a consul user event called name with ev JSON
+//encoded as payload.
+func FireTransitionEvent(client *Client, name string, ev *TransitionEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, _, err = client.Event().Fire(&consulapi.UserEvent{Name: name, Payload: b}, nil)
+	return err
+}
@@ -10,18 +10,37 @@ import (
 	apixtra "github.com/jmcarbo/consul-apixtra"
 	//"github.com/nu7hatch/gouuid"
 	"encoding/json"
-	"gopkg.in/yaml.v2"
+	"errors"
 	"io"
-	"io/ioutil"
 	"strings"
 	"sync"
 	"time"
 )
 
-//Connect establishes a connection to local running consul agent.
-//Currently only localhost:8500 is supported.
-func Connect(address, datacenter, token string) *consulapi.Client {
+//Client is a consul client together with the configuration it was made
+//with. consul-api does not expose it and it is needed to reach the endpoints
+//consul-api does not implement, such as transactions.
+type Client struct {
+	*consulapi.Client
+	config consulapi.Config
+}
+
+//NewClient makes a consul client with config.
+func NewClient(config *consulapi.Config) (*Client, error) {
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Client: client, config: *config}, nil
+}
+
+//Connect establishes a connection to the consul agent at address, which
+//may be given as a URL such as https://consul:8501 to choose the scheme.
+func Connect(address, datacenter, token string) *Client {
 	config := consulapi.DefaultConfig()
+	if i := strings.Index(address, "://"); i >= 0 {
+		config.Scheme, address = address[:i], strings.TrimSuffix(address[i+3:], "/")
+	}
 	if address != "" {
 		config.Address = address
 	}
@@ -31,11 +50,10 @@ func Connect(address, datacenter, token string) *consulapi.Client {
 	if token != "" {
 		config.Token = token
 	}
-	client, err := consulapi.NewClient(config)
+	client, err := NewClient(config)
 	if err != nil {
 		log.Fatal(err)
 	}
-
 	return client
 }
 
@@ -46,41 +64,57 @@ func Connect(address, datacenter, token string) *consulapi.Client {
 type ExternalService struct {
 	service    string
 	node       string
-	client     *consulapi.Client
+	client     *Client
 	definition *ExternalServiceDefinition
 }
 
 //ExternalServiceDefinition holds the ExternalService characteristics:
-// Address, Port, Command, Interval and TargetState. TargetState must be one of:
+// Address, Port, Command, Interval, TargetState, Tags and CheckType. TargetState must be one of:
 // "stopped" (if you currently do not want the service to be watched), "running" (if
 // you DO want the service to be watched), and "deleted" if you want the service
-// definition to be deleted by the service node watcher.
+// definition to be deleted by the service node watcher. CheckType is "script" (the
+// default) to run Command every Interval, or "ttl" for a check that must be updated
+// through consul's agent API at least every Interval.
 type ExternalServiceDefinition struct {
-	Address     string
-	Port        int
-	Command     string
-	State       string
-	Interval    string
-	TargetState string
+	Address     string   `yaml:"address"`
+	Port        int      `yaml:"port"`
+	Command     string   `yaml:"command"`
+	State       string   `yaml:"state,omitempty"`
+	Interval    string   `yaml:"interval"`
+	TargetState string   `yaml:"targetstate"`
+	Tags        []string `json:",omitempty" yaml:"tags,omitempty"`
+	CheckType   string   `json:",omitempty" yaml:"checktype,omitempty"`
 }
 
-func NewExternalService(client *consulapi.Client, service, node, address string, port int, command string, interval string) *ExternalService {
+func NewExternalService(client *Client, service, node, address string, port int, command string, interval string) *ExternalService {
 	if interval == "" {
 		interval = "10s"
 	}
-	es := &ExternalService{service: service, node: node,
-		definition: &ExternalServiceDefinition{Address: address, Port: port, Command: command, TargetState: "stopped", Interval: interval}, client: client}
-
-	esKey := fmt.Sprintf("ExternalServices/%s/%s", es.node, es.service)
-	b, _ := json.Marshal(es.definition)
-	_, err := es.client.KV().Put(&consulapi.KVPair{Key: esKey, Value: b}, nil)
-	if err != nil {
+	es := NewExternalServiceFromDefinition(client, service, node,
+		&ExternalServiceDefinition{Address: address, Port: port, Command: command, TargetState: "stopped", Interval: interval})
+	if err := es.Save(); err != nil {
 		return nil
 	}
 	return es
 }
 
-func NewExternalServiceFromConsul(client *consulapi.Client, service, node string) *ExternalService {
+//NewExternalServiceFromDefinition returns the external service for esd
+//without storing it in consul. Use Save to store it.
+func NewExternalServiceFromDefinition(client *Client, service, node string, esd *ExternalServiceDefinition) *ExternalService {
+	return &ExternalService{service: service, node: node, definition: esd, client: client}
+}
+
+//ExternalServiceExists reports whether a definition is stored for service
+//in node.
+func ExternalServiceExists(client *Client, service, node string) (bool, error) {
+	kvp, _, err := client.KV().Get(fmt.Sprintf("ExternalServices/%s/%s", node, service), nil)
+	if err != nil {
+		return false, err
+	}
+	return kvp != nil, nil
+}
+
+func NewExternalServiceFromConsul(client *Client, service, node string) *ExternalService {
 
 	esKey := fmt.Sprintf("ExternalServices/%s/%s", node, service)
 	kvp, _, err := client.KV().Get(esKey, nil)
@@ -106,45 +140,27 @@ func NewExternalServiceFromConsul(client *consulapi.Client, service, node string
 	return es
 }
 
-type BackupKV struct {
-	Key, Value string
-}
-
-func BackupExternalServicesToYAML(client *consulapi.Client, fileName string) error {
-	kvp, _, _ := client.KV().List("ExternalServices", nil)
-	var kv []BackupKV
-	for _, a := range kvp {
-		kv = append(kv, BackupKV{Key: a.Key, Value: string(a.Value)})
-	}
+//ErrConflict is returned by SaveCAS when the definition has been changed
+//or deleted since it was loaded.
+var ErrConflict = errors.New("definition changed since it was loaded")
 
-	d, err := yaml.Marshal(kv)
-	if err != nil {
-		log.Fatalf("error: %v", err)
-	}
-	//fmt.Printf("--- t dump:\n%s\n\n", string(d))
-	ioutil.WriteFile(fileName, d, 0644)
-	return nil
-}
-
-func RestoreExternalServicesFromYAML(client *consulapi.Client, fileName string) error {
-	var kv []BackupKV
-	vals, err := ioutil.ReadFile(fileName)
+//LoadExternalService is like NewExternalServiceFromConsul but reports why
+//the service could not be loaded, and returns the ModifyIndex of its key to
+//be used with SaveCAS. The returned service is nil if it is not defined.
+func LoadExternalService(client *Client, service, node string) (*ExternalService, uint64, error) {
+	esKey := fmt.Sprintf("ExternalServices/%s/%s", node, service)
+	kvp, _, err := client.KV().Get(esKey, nil)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		return nil, 0, err
 	}
-	err = yaml.Unmarshal(vals, &kv)
-	if err != nil {
-		log.Fatalf("error: %v", err)
+	if kvp == nil {
+		return nil, 0, nil
 	}
-	kvc := client.KV()
-	for _, a := range kv {
-		//fmt.Printf("%s\n%s\n", a.Key, string(a.Value))
-		_, err := kvc.Put(&consulapi.KVPair{Key: a.Key, Value: []byte(a.Value)}, nil)
-		if err != nil {
-			log.Fatalf("error: %v", err)
-		}
+	var esd ExternalServiceDefinition
+	if err := json.Unmarshal(kvp.Value, &esd); err != nil {
+		return nil, 0, fmt.Errorf("decoding %s: %v", esKey, err)
 	}
-	return nil
+	return &ExternalService{service: service, node: node, definition: &esd, client: client}, kvp.ModifyIndex, nil
 }
 
 func (es *ExternalService) SetCheckInterval(interval string) error {
@@ -152,36 +168,90 @@ func (es *ExternalService) SetCheckInterval(interval string) error {
 	return nil
 }
 
+//saveAttempts is the number of times Save, SaveCAS and
+//SetExternalServiceTargetState try to write a definition that keeps being
+//changed, or its revision, concurrently.
+const saveAttempts = 10
+
+//Save stores the definition, keeping the one it replaces as a revision. It
+//retries if the definition is changed while being saved, so the revision
+//kept is always the definition replaced.
 func (es *ExternalService) Save() error {
 	esKey := fmt.Sprintf("ExternalServices/%s/%s", es.node, es.service)
-	b, _ := json.Marshal(es.definition)
-	_, err := es.client.KV().Put(&consulapi.KVPair{Key: esKey, Value: b}, nil)
+	for attempt := 1; ; attempt++ {
+		old, _, err := es.client.KV().Get(esKey, nil)
+		if err != nil {
+			return err
+		}
+		err = es.save(old)
+		if _, ok := err.(*TxnError); !ok || attempt == saveAttempts {
+			return err
+		}
+	}
+}
+
+//SaveCAS stores the definition only if its key has not been modified since
+//index, as returned by LoadExternalService. An index of 0 only stores it if
+//the service is not defined yet. It returns ErrConflict otherwise. The
+//definition replaced is kept as a revision.
+func (es *ExternalService) SaveCAS(index uint64) error {
+	esKey := fmt.Sprintf("ExternalServices/%s/%s", es.node, es.service)
+	for attempt := 1; ; attempt++ {
+		old, _, err := es.client.KV().Get(esKey, nil)
+		if err != nil {
+			return err
+		}
+		if (old == nil && index != 0) || (old != nil && old.ModifyIndex != index) {
+			return ErrConflict
+		}
+		//A failed transaction is retried only if the definition is
+		//unchanged, when the revision number was taken by another write.
+		err = es.save(old)
+		if _, ok := err.(*TxnError); !ok || attempt == saveAttempts {
+			return err
+		}
+	}
+}
+
+//save writes the definition with check-and-set over old, the pair it
+//replaces or nil, in the same transaction as the revision keeping old.
+func (es *ExternalService) save(old *consulapi.KVPair) error {
+	b, err := json.Marshal(es.definition)
 	if err != nil {
 		return err
 	}
-	return nil
+	w := &kvWrite{Key: fmt.Sprintf("ExternalServices/%s/%s", es.node, es.service), Value: b, Previous: old}
+	if old != nil {
+		w.Index = old.ModifyIndex
+	}
+	return writeDefinitions(es.client, []*kvWrite{w})
 }
 
 func (es *ExternalService) Register() error {
 	//log.Infof("%#v", es.definition)
 	_, err := es.client.Catalog().Register(&consulapi.CatalogRegistration{Node: es.node, Address: es.definition.Address,
-		Service: &consulapi.AgentService{ID: es.service, Service: es.service, Port: es.definition.Port}}, nil)
+		Service: &consulapi.AgentService{ID: es.service, Service: es.service, Port: es.definition.Port, Tags: es.definition.Tags}}, nil)
 	if err != nil {
 		return err
 	}
 
 	if !es.CheckExists() {
-		checkName := fmt.Sprintf("check:%s:%s", es.service, es.node)
-		//log.Infof("----> Registering %s", checkName)
-		err = es.client.Agent().CheckRegister(&consulapi.AgentCheckRegistration{checkName, checkName, "",
-			consulapi.AgentServiceCheck{Interval: es.definition.Interval, Script: es.definition.Command}})
-		if err != nil {
-			return err
-		}
+		return es.registerCheck()
 	}
 	return nil
 }
 
+//registerCheck registers the check of es on the local agent.
+func (es *ExternalService) registerCheck() error {
+	checkName := fmt.Sprintf("check:%s:%s", es.service, es.node)
+	//log.Infof("----> Registering %s", checkName)
+	check := consulapi.AgentServiceCheck{Interval: es.definition.Interval, Script: es.definition.Command}
+	if es.definition.CheckType == CheckTTL {
+		check = consulapi.AgentServiceCheck{TTL: es.definition.Interval}
+	}
+	return es.client.Agent().CheckRegister(&consulapi.AgentCheckRegistration{ID: checkName, Name: checkName, AgentServiceCheck: check})
+}
+
 func (es *ExternalService) IsActive() bool {
 	cs, _, err := es.client.Catalog().Service(es.service, "", nil)
 	if err != nil {
@@ -211,12 +281,42 @@ func (es *ExternalService) UnregisterService() error {
 	return nil
 }
 
+//SetTargetState sets the target state of the service as it is defined in
+//consul now, like SetExternalServiceTargetState, and updates the definition
+//of es to the one saved.
 func (es *ExternalService) SetTargetState(state string) error {
-	es.definition.TargetState = state
-	es.Save()
+	saved, err := SetExternalServiceTargetState(es.client, es.service, es.node, state)
+	if err != nil {
+		return err
+	}
+	es.definition = saved.definition
 	return nil
 }
 
+//SetExternalServiceTargetState reloads the definition of service in node,
+//changes only its target state and saves it with check-and-set, retrying
+//when it is changed concurrently. Changes made by others since the service
+//was listed are kept. It returns the service saved.
+func SetExternalServiceTargetState(client *Client, service, node, state string) (*ExternalService, error) {
+	for attempt := 1; ; attempt++ {
+		es, index, err := LoadExternalService(client, service, node)
+		if err != nil {
+			return nil, err
+		}
+		if es == nil {
+			return nil, fmt.Errorf("%s/%s is no longer defined", node, service)
+		}
+		es.definition.TargetState = state
+		err = es.SaveCAS(index)
+		if err == nil {
+			return es, nil
+		}
+		if err != ErrConflict || attempt == saveAttempts {
+			return nil, err
+		}
+	}
+}
+
 func (es *ExternalService) Unregister() error {
 
 	checkName := fmt.Sprintf("check:%s:%s", es.service, es.node)
@@ -271,32 +371,49 @@ func (es *ExternalService) CheckStatus() string {
 	return "unknown"
 }
 
+//Destroy removes the definition of es together with its revisions.
+//Destroy deletes the definition of the service. The definition deleted is
+//kept as a revision in the same transaction, and the revisions are kept
+//after it, so a removal can be rolled back.
 func (es *ExternalService) Destroy() error {
 	eKey := fmt.Sprintf("ExternalServices/%s/%s", es.node, es.service)
-	_, err := es.client.KV().Delete(eKey, nil)
-	return err
+	for attempt := 1; ; attempt++ {
+		old, _, err := es.client.KV().Get(eKey, nil)
+		if err != nil || old == nil {
+			return err
+		}
+		err = writeDefinitions(es.client, []*kvWrite{{Key: eKey, Index: old.ModifyIndex, Previous: old, Delete: true}})
+		if _, ok := err.(*TxnError); !ok || attempt == saveAttempts {
+			return err
+		}
+	}
 }
 
-func DestroyAllExternalServices(client *consulapi.Client) error {
-	_, err := client.KV().DeleteTree("ExternalServices", nil)
+func DestroyAllExternalServices(client *Client) error {
+	_, err := client.KV().DeleteTree("ExternalServices/", nil)
 	return err
 }
 
 type ExternalServiceWatcher struct {
-	node   string
-	client *consulapi.Client
-	state  string
-	slock  sync.Mutex
-	kvlock *apixtra.Lock
-	stopCh chan struct{}
-	doneCh chan struct{}
+	node     string
+	client   *Client
+	state    string
+	slock    sync.Mutex
+	kvlock   *apixtra.Lock
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	tlock    sync.Mutex
+	statuses map[string]string
+	catalog  map[string]string
+	event    string
 }
 
-func NewExternalServiceWatcher(client *consulapi.Client, node string) *ExternalServiceWatcher {
-	esw := &ExternalServiceWatcher{client: client, node: node}
+func NewExternalServiceWatcher(client *Client, node string) *ExternalServiceWatcher {
+	esw := &ExternalServiceWatcher{client: client, node: node, statuses: make(map[string]string),
+		catalog: make(map[string]string)}
 	esw.setState("stopped")
 	esKey := fmt.Sprintf("ExternalServicesWatchers/%s", esw.node)
-	esw.kvlock = apixtra.NewLock(client, esKey)
+	esw.kvlock = apixtra.NewLock(client.Client, esKey)
 	if esw.kvlock == nil {
 		return nil
 	}
@@ -311,6 +428,124 @@ func (esw *ExternalServiceWatcher) setState(state string) {
 	esw.slock.Unlock()
 }
 
+//observe records a Transition when the check status of a service differs
+//from the last one seen. The first time a service is seen its status is
+//compared with the last recorded transition, so restarting the watcher or
+//a change of leader does not record spurious transitions. tlock is only held
+//to read and update the statuses, never during consul requests, so the
+//watcher loops do not wait on each other's requests.
+func (esw *ExternalServiceWatcher) observe(service, status string, index uint64) {
+	esw.tlock.Lock()
+	last, seen := esw.statuses[service]
+	esw.tlock.Unlock()
+	if !seen {
+		t, err := LastTransition(esw.client, esw.node, service)
+		if err != nil {
+			esw.logger(service, index).WithField("error", err).Error("getting last transition")
+			return
+		}
+		if t != nil {
+			last = t.To
+		}
+	}
+	esw.tlock.Lock()
+	//A status seen by the other loop meanwhile is newer than the last
+	//transition recorded.
+	if previous, ok := esw.statuses[service]; ok {
+		last = previous
+	}
+	esw.statuses[service] = status
+	esw.tlock.Unlock()
+	if last == status || (last == "" && status == StatusStopped) {
+		return
+	}
+	l := esw.logger(service, index).WithFields(log.Fields{"from": last, "to": status})
+	l.Info("check status changed")
+	err := RecordTransition(esw.client, &Transition{Node: esw.node, Service: service, From: last, To: status, Time: time.Now()})
+	if err != nil {
+		l.WithField("error", err).Error("recording transition")
+	}
+}
+
+//SetTransitionEvent makes the watcher fire a consul user event called name,
+//with a TransitionEvent as payload, every time it registers or deregisters
+//a service. An empty name disables the events.
+func (esw *ExternalServiceWatcher) SetTransitionEvent(name string) {
+	esw.event = name
+}
+
+func (esw *ExternalServiceWatcher) catalogState(es *ExternalService) string {
+	esw.tlock.Lock()
+	state, ok := esw.catalog[es.service]
+	esw.tlock.Unlock()
+	if ok {
+		return state
+	}
+	if es.IsActive() {
+		return CatalogRegistered
+	}
+	return CatalogDeregistered
+}
+
+func (esw *ExternalServiceWatcher) catalogChanged(es *ExternalService, old, state string, index uint64) {
+	esw.tlock.Lock()
+	esw.catalog[es.service] = state
+	esw.tlock.Unlock()
+	if old == state {
+		return
+	}
+	l := esw.logger(es.service, index).WithFields(log.Fields{"from": old, "to": state})
+	l.Info("catalog state changed")
+	if esw.event == "" {
+		return
+	}
+	err := FireTransitionEvent(esw.client, esw.event, &TransitionEvent{Node: es.node, Service: es.service, Old: old, New: state})
+	if err != nil {
+		l.WithFields(log.Fields{"event": esw.event, "error": err}).Error("firing transition event")
+	}
+}
+
+//register registers es in the catalog and announces it when the service
+//was not registered before.
+func (esw *ExternalServiceWatcher) register(es *ExternalService, index uint64) error {
+	old := esw.catalogState(es)
+	if err := es.Register(); err != nil {
+		esw.logger(es.service, index).WithField("error", err).Error("registering service")
+		return err
+	}
+	esw.catalogChanged(es, old, CatalogRegistered, index)
+	return nil
+}
+
+//deregister removes es from the catalog, together with its check unless
+//keepCheck is set, and announces it when the service was registered before.
+func (esw *ExternalServiceWatcher) deregister(es *ExternalService, keepCheck bool, index uint64) error {
+	old := esw.catalogState(es)
+	var err error
+	if keepCheck {
+		err = es.UnregisterService()
+	} else {
+		err = es.Unregister()
+	}
+	if err != nil {
+		esw.logger(es.service, index).WithFields(log.Fields{"error": err, "keep_check": keepCheck}).Error("deregistering service")
+		return err
+	}
+	esw.catalogChanged(es, old, CatalogDeregistered, index)
+	return nil
+}
+
+//logger returns a log entry carrying the fields that identify a service of
+//the watcher and the consul index the watcher is acting upon.
+func (esw *ExternalServiceWatcher) logger(service string, index uint64) *log.Entry {
+	fields := log.Fields{"node": esw.node, "leader": esw.IsLeader(), "index": index}
+	if service != "" {
+		fields["service"] = service
+		fields["check"] = fmt.Sprintf("check:%s:%s", service, esw.node)
+	}
+	return log.WithFields(fields)
+}
+
 func (esw *ExternalServiceWatcher) IsLeader() bool {
 	return esw.kvlock.IsLeader()
 }
@@ -333,8 +568,12 @@ func (esw *ExternalServiceWatcher) Run() error {
 		for {
 			keys, qm, err := esw.client.KV().List(qname, &consulapi.QueryOptions{AllowStale: false, RequireConsistent: true, WaitTime: dur, WaitIndex: modi})
 			if err != nil {
+				esw.logger("", modi).WithField("error", err).Error("watching service definitions, stopping")
 				return
 			}
+			if qm.LastIndex != modi {
+				esw.logger("", qm.LastIndex).WithField("definitions", len(keys)).Debug("service definitions changed")
+			}
 
 			for _, a := range keys {
 				parts := strings.Split(a.Key, "/")
@@ -346,16 +585,22 @@ func (esw *ExternalServiceWatcher) Run() error {
 					if es != nil {
 						if es.definition.TargetState == "running" {
 							if !es.CheckExists() {
-								es.Register()
+								esw.register(es, qm.LastIndex)
 							}
 						}
 						if es.definition.TargetState == "stopped" {
 							//log.Printf("%#v", es.definition)
-							es.Unregister()
+							esw.deregister(es, false, qm.LastIndex)
+							esw.observe(service, StatusStopped, qm.LastIndex)
 						}
 						if es.definition.TargetState == "deleted" {
-							es.Unregister()
-							es.Destroy()
+							esw.deregister(es, false, qm.LastIndex)
+							if err := es.Destroy(); err != nil {
+								esw.logger(service, qm.LastIndex).WithField("error", err).Error("deleting service definition")
+							} else {
+								esw.logger(service, qm.LastIndex).Info("service definition deleted")
+							}
+							esw.observe(service, StatusStopped, qm.LastIndex)
 						}
 					}
 				}
@@ -367,6 +612,7 @@ func (esw *ExternalServiceWatcher) Run() error {
 				return
 			default:
 				if !esw.kvlock.IsLeader() {
+					esw.logger("", modi).Warn("leadership lost, stopping")
 					return
 				}
 			}
@@ -387,6 +633,7 @@ func (esw *ExternalServiceWatcher) Run() error {
 			//keys, qm, err := esw.client.KV().List("ExternalServices", &consulapi.QueryOptions{AllowStale: false, RequireConsistent: true, WaitTime: dur, WaitIndex: modi})
 			hcks, qm, err := esw.client.Health().State("any", &consulapi.QueryOptions{AllowStale: false, RequireConsistent: true, WaitTime: dur, WaitIndex: modi})
 			if err != nil {
+				esw.logger("", modi).WithField("error", err).Error("watching health checks, stopping")
 				return
 			}
 
@@ -400,25 +647,21 @@ func (esw *ExternalServiceWatcher) Run() error {
 						//log.Infof("Getting %s x--------> %s", service, node)
 						es := NewExternalServiceFromConsul(esw.client, service, node)
 						if es != nil {
+							esw.observe(service, a.Status, qm.LastIndex)
 							if a.Status == "passing" && es.definition.TargetState == "running" {
-								es.Register()
+								esw.register(es, qm.LastIndex)
 								//log.Infof("Registering %s --------> %s ----> %s ----> %s", service, node, esw.node, a.Status)
 							}
 							if a.Status == "critical" {
 								if es.definition.TargetState != "running" {
-									err := es.Unregister()
-									if err != nil {
-										log.Error("unregistering service %s", service)
-									}
+									esw.deregister(es, false, qm.LastIndex)
 								} else {
-									err := es.UnregisterService()
-									if err != nil {
-										log.Error("unregistering service %s. Check still active", service)
-									}
+									esw.deregister(es, true, qm.LastIndex)
 								}
 								//log.Infof("UnRegistering %s --------> %s ----> %s ----> %s", service, node, esw.node, a.Status)
 							}
 						} else {
+							esw.logger(service, qm.LastIndex).Info("removing check of undefined service")
 							esw.client.Agent().CheckDeregister(a.Name)
 						}
 
@@ -432,6 +675,7 @@ func (esw *ExternalServiceWatcher) Run() error {
 				return
 			default:
 				if !esw.kvlock.IsLeader() {
+					esw.logger("", modi).Warn("leadership lost, stopping")
 					return
 				}
 			}
@@ -87,6 +87,110 @@ func TestExternalService(t *testing.T) {
 			g.Assert(err).Equal(nil)
 		})
 
+		g.It("can be listed with status", func() {
+			client := Connect("", "", "")
+			NewExternalService(client, "testlock12", "node2", "localhost", 80, "ping -c 2 localhost", "2s")
+			statuses, err := ExternalServicesStatus(client, "node2", 5)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(statuses)).Equal(1)
+			g.Assert(statuses[0].Service).Equal("testlock12")
+			g.Assert(statuses[0].Definition.TargetState).Equal("stopped")
+			g.Assert(statuses[0].Registered).IsFalse()
+		})
+
+		g.It("refuses to save over a concurrent change", func() {
+			client := Connect("", "", "")
+			NewExternalService(client, "testlock13", "node2", "localhost", 80, "ping -c 2 localhost", "2s")
+			es, index, err := LoadExternalService(client, "testlock13", "node2")
+			g.Assert(err == nil).IsTrue()
+			other, _, _ := LoadExternalService(client, "testlock13", "node2")
+			other.SetCheckInterval("5s")
+			g.Assert(other.Save() == nil).IsTrue()
+			es.SetCheckInterval("3s")
+			g.Assert(es.SaveCAS(index)).Equal(ErrConflict)
+		})
+
+		g.It("keeps concurrent changes when setting the target state", func() {
+			client := Connect("", "", "")
+			es := NewExternalServiceFromConsul(client, "testlock13", "node2")
+			other, _, _ := LoadExternalService(client, "testlock13", "node2")
+			other.SetCheckInterval("9s")
+			g.Assert(other.Save() == nil).IsTrue()
+			g.Assert(es.SetTargetState("running") == nil).IsTrue()
+			saved := NewExternalServiceFromConsul(client, "testlock13", "node2")
+			g.Assert(saved.Definition().Interval).Equal("9s")
+			g.Assert(saved.Definition().TargetState).Equal("running")
+		})
+
+		g.It("keeps revisions and rolls back", func() {
+			client := Connect("", "", "")
+			es := NewExternalService(client, "testlock14", "node2", "localhost", 80, "ping -c 2 localhost", "2s")
+			es.SetCheckInterval("5s")
+			g.Assert(es.Save() == nil).IsTrue()
+			es.SetCheckInterval("7s")
+			g.Assert(es.Save() == nil).IsTrue()
+			revisions, err := ListRevisions(client, "node2", "testlock14")
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(revisions)).Equal(2)
+			g.Assert(revisions[0].Definition.Interval).Equal("2s")
+
+			diffs, err := RollbackExternalService(client, "node2", "testlock14", revisions[0].Number)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(diffs[0].String()).Equal(`interval: "7s" -> "2s"`)
+			revisions, _ = ListRevisions(client, "node2", "testlock14")
+			g.Assert(revisions[len(revisions)-1].Definition.Interval).Equal("7s")
+
+			kept := len(revisions)
+			g.Assert(NewExternalServiceFromConsul(client, "testlock14", "node2").Destroy() == nil).IsTrue()
+			revisions, _ = ListRevisions(client, "node2", "testlock14")
+			g.Assert(len(revisions)).Equal(kept + 1)
+			removed := revisions[len(revisions)-1]
+			g.Assert(removed.Definition.Interval).Equal("2s")
+			_, err = RollbackExternalService(client, "node2", "testlock14", removed.Number)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(NewExternalServiceFromConsul(client, "testlock14", "node2").Definition().Interval).Equal("2s")
+		})
+
+		g.It("can plan and apply definitions", func() {
+			client := Connect("", "", "")
+			NewExternalService(client, "testlock20", "node3", "localhost", 80, "ping -c 2 localhost", "2s")
+			NewExternalService(client, "testlock21", "node3", "localhost", 80, "ping -c 2 localhost", "2s")
+			desired := []*NamedDefinition{
+				{Node: "node3", Service: "testlock20", Definition: &ExternalServiceDefinition{Address: "localhost", Port: 81, Command: "ping -c 2 localhost", Interval: "2s", TargetState: "stopped"}},
+				{Node: "node3", Service: "testlock22", Definition: &ExternalServiceDefinition{Address: "localhost", Port: 80, Command: "ping -c 2 localhost", Interval: "2s", TargetState: "stopped"}},
+			}
+			plan, err := PlanExternalServices(client, desired, PruneNodesOf(desired))
+			g.Assert(err == nil).IsTrue()
+			g.Assert(plan.Count(PlanUpdate)).Equal(1)
+			g.Assert(plan.Count(PlanCreate)).Equal(1)
+			var deleted []string
+			for _, e := range plan {
+				if e.Action == PlanDelete {
+					deleted = append(deleted, e.Node+"/"+e.Service)
+				}
+			}
+			g.Assert(deleted).Equal([]string{"node3/testlock21"})
+			_, err = ApplyPlan(client, plan)
+			g.Assert(err == nil).IsTrue()
+			es := NewExternalServiceFromConsul(client, "testlock21", "node3")
+			g.Assert(es.Definition().TargetState).Equal("deleted")
+			plan, err = PlanExternalServices(client, desired, nil)
+			g.Assert(plan.Changes()).IsFalse()
+
+			//Without definitions of node3 only an explicit prune of node3
+			//plans the deletion of its services.
+			plan, err = PlanExternalServices(client, nil, PruneNodesOf(nil))
+			g.Assert(err == nil).IsTrue()
+			g.Assert(plan.Count(PlanDelete)).Equal(0)
+			plan, err = PlanExternalServices(client, nil, PruneNodes("node3"))
+			g.Assert(err == nil).IsTrue()
+			deleted = nil
+			for _, e := range plan {
+				deleted = append(deleted, e.Action+" "+e.Node+"/"+e.Service)
+			}
+			g.Assert(deleted).Equal([]string{"delete node3/testlock20", "delete node3/testlock22"})
+		})
+
 		g.It("can be backed up to YAML file", func() {
 			client := Connect("", "", "")
 			NewExternalService(client, "testlock15", "node1", "localhost", 80, "ping -c 2 ost", "2s")
@@ -99,6 +203,71 @@ func TestExternalService(t *testing.T) {
 			err := RestoreExternalServicesFromYAML(client, "backup.yaml")
 			g.Assert(err == nil).IsTrue()
 		})
+		g.It("reports what was restored", func() {
+			client := Connect("", "", "")
+			ioutil.WriteFile("restore.yaml", []byte("- key: ExternalServices/node1/testlock17\n  value: '{}'\n- key: ExternalServicesWatchers/node1\n  value: \"\"\n"), 0644)
+			defer os.Remove("restore.yaml")
+			summary, err := RestoreExternalServices(client, "restore.yaml", &RestoreOptions{ContinueOnError: true})
+			g.Assert(err == nil).IsTrue()
+			g.Assert(summary.Restored).Equal([]string{"ExternalServices/node1/testlock17"})
+			g.Assert(summary.Skipped).Equal([]string{"ExternalServicesWatchers/node1"})
+
+			_, err = RestoreExternalServices(client, "missing.yaml", nil)
+			_, ok := err.(*FileError)
+			g.Assert(ok).IsTrue()
+		})
+		g.It("restores all keys or none", func() {
+			client := Connect("", "", "")
+			ioutil.WriteFile("restore.yaml", []byte("version: 2\nservices:\n- {node: node1, service: testlock17, address: localhost, command: 'true', interval: 1s, targetstate: stopped}\n- {node: node1, service: testlock18, address: localhost, command: 'true', interval: 1s, targetstate: stopped}\n"), 0644)
+			defer os.Remove("restore.yaml")
+			summary, err := RestoreExternalServices(client, "restore.yaml", &RestoreOptions{Mode: RestoreFailIfExists})
+			g.Assert(err != nil).IsTrue()
+			g.Assert(summary.NotAttempted).Equal([]string{"ExternalServices/node1/testlock18"})
+			exists, _ := ExternalServiceExists(client, "testlock18", "node1")
+			g.Assert(exists).IsFalse()
+
+			summary, err = RestoreExternalServices(client, "restore.yaml", &RestoreOptions{Mode: RestoreSkipExisting})
+			g.Assert(err == nil).IsTrue()
+			g.Assert(summary.Existing).Equal([]string{"ExternalServices/node1/testlock17"})
+			g.Assert(summary.Restored).Equal([]string{"ExternalServices/node1/testlock18"})
+		})
+		g.It("keeps revisions of restored definitions", func() {
+			client := Connect("", "", "")
+			ioutil.WriteFile("restore.yaml", []byte("version: 2\nservices:\n- {node: node1, service: testlock16, address: localhost, port: 80, command: 'true', interval: 2s, targetstate: stopped}\n"), 0644)
+			defer os.Remove("restore.yaml")
+			_, err := RestoreExternalServices(client, "restore.yaml", nil)
+			g.Assert(err == nil).IsTrue()
+			revisions, err := ListRevisions(client, "node1", "testlock16")
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(revisions)).Equal(1)
+			g.Assert(revisions[0].Definition.Command).Equal("ping -c 2 ost")
+		})
+		g.It("can be snapshotted and restored", func() {
+			client := Connect("", "", "")
+			es := NewExternalService(client, "testlock19", "node4", "localhost", 80, "ping -c 2 localhost", "2s")
+			g.Assert(es.Register() == nil).IsTrue()
+			snap, err := WriteSnapshot(client, "snapshot.yaml", &Encryption{Passphrase: "secret"})
+			defer os.Remove("snapshot.yaml")
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(snap.Catalog) > 0).IsTrue()
+
+			es.Unregister()
+			es.Destroy()
+			snap, err = ReadSnapshot("snapshot.yaml", &Encryption{Passphrase: "secret"})
+			g.Assert(err == nil).IsTrue()
+			summary, err := RestoreSnapshot(client, snap, true)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(summary.Invalid)).Equal(1)
+			g.Assert(summary.Invalid[0].Key).Equal("ExternalServices/node1/testlock17")
+			rebuilt := false
+			for _, key := range summary.Services {
+				rebuilt = rebuilt || key == "node4/testlock19"
+			}
+			g.Assert(rebuilt).IsTrue()
+			exists, _ := ExternalServiceExists(client, "testlock19", "node4")
+			g.Assert(exists).IsTrue()
+			g.Assert(NewExternalServiceFromConsul(client, "testlock19", "node4").CheckExists()).IsTrue()
+		})
 	})
 
 	g.Describe("externalservicewatcher", func() {
@@ -278,6 +447,36 @@ func TestExternalService(t *testing.T) {
 			es.Unregister()
 		})
 
+		g.It("fires transition events", func() {
+			client := Connect("", "", "")
+			esw := NewExternalServiceWatcher(client, "node12")
+			esw.SetTransitionEvent(DefaultTransitionEvent)
+			esw.Run()
+			es := NewExternalService(client, "testlock1", "node12", "localhost", 80, "ping -c 1 localhost", "1s")
+			es.SetTargetState("running")
+			time.Sleep(time.Second * 5)
+			events, _, err := client.Event().List(DefaultTransitionEvent, nil)
+			g.Assert(err == nil).IsTrue()
+			g.Assert(len(events) > 0).IsTrue()
+			esw.Destroy()
+			es.SetTargetState("stopped")
+			es.Unregister()
+		})
+
+		g.It("converges target state changes", func() {
+			client := Connect("", "", "")
+			esw := NewExternalServiceWatcher(client, "node13")
+			esw.Run()
+			es := NewExternalService(client, "testlock1", "node13", "localhost", 80, "ping -c 1 localhost", "1s")
+			es.SetTargetState("running")
+			g.Assert(WaitConverged([]*ExternalService{es}, 10*time.Second) == nil).IsTrue()
+			g.Assert(es.IsActive()).IsTrue()
+			es.SetTargetState("stopped")
+			g.Assert(WaitConverged([]*ExternalService{es}, 10*time.Second) == nil).IsTrue()
+			g.Assert(es.IsActive()).IsFalse()
+			esw.Destroy()
+		})
+
 		g.It("cannot run two watchers on same node", func() {
 			client := Connect("", "", "")
 			esw := NewExternalServiceWatcher(client, "b")
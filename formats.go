@@ -0,0 +1,403 @@
+package consul_externalservice
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"gopkg.in/yaml.v2"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//Formats of export files.
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatHCL  = "hcl"
+	FormatCSV  = "csv"
+)
+
+//csvColumns are the columns of CSV export files. Tags are separated by ';'.
+var csvColumns = []string{"node", "service", "address", "port", "command", "checktype", "interval", "targetstate", "tags"}
+
+//FormatFromFileName returns the format of an export file from its
+//extension, FormatYAML if it is not known.
+func FormatFromFileName(fileName string) string {
+	fileName = strings.TrimSuffix(fileName, EncryptedSuffix)
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return FormatJSON
+	case ".hcl":
+		return FormatHCL
+	case ".csv":
+		return FormatCSV
+	}
+	return FormatYAML
+}
+
+//resolveFormat returns format, or the format of fileName if it is empty.
+func resolveFormat(fileName, format string) (string, error) {
+	switch format {
+	case "":
+		return FormatFromFileName(fileName), nil
+	case FormatYAML, FormatJSON, FormatHCL, FormatCSV:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q, must be yaml, json, hcl or csv", format)
+}
+
+//exportField is a field of an exported service, in the order written.
+type exportField struct {
+	Name  string
+	Value interface{}
+}
+
+//exportFields returns the fields written for es by the JSON and HCL formats.
+//They use the same names as the YAML format.
+func exportFields(es *ExportedService) []exportField {
+	d := &es.Definition
+	fields := []exportField{{"node", es.Node}, {"service", es.Service}, {"address", d.Address}, {"port", d.Port}}
+	if d.Command != "" {
+		fields = append(fields, exportField{"command", d.Command})
+	}
+	if d.CheckType != "" {
+		fields = append(fields, exportField{"checktype", d.CheckType})
+	}
+	if d.State != "" {
+		fields = append(fields, exportField{"state", d.State})
+	}
+	fields = append(fields, exportField{"interval", d.Interval}, exportField{"targetstate", d.TargetState})
+	if len(d.Tags) > 0 {
+		fields = append(fields, exportField{"tags", d.Tags})
+	}
+	return fields
+}
+
+//encodeExport encodes ex in format.
+func encodeExport(ex *ExportFile, format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return encodeJSONExport(ex)
+	case FormatHCL:
+		return encodeHCLExport(ex)
+	case FormatCSV:
+		return encodeCSVExport(ex)
+	}
+	return yaml.Marshal(ex)
+}
+
+//marshalJSON is json.Marshal without escaping &, < and >, which are common
+//in check commands and are kept readable in export files.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func encodeJSONExport(ex *ExportFile) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{\n  \"version\": %d,\n  \"services\": [", ex.Version)
+	for i, es := range ex.Services {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n    {")
+		for j, f := range exportFields(es) {
+			v, err := marshalJSON(f.Value)
+			if err != nil {
+				return nil, err
+			}
+			if j > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, "\n      %q: %s", f.Name, v)
+		}
+		buf.WriteString("\n    }")
+	}
+	if len(ex.Services) > 0 {
+		buf.WriteString("\n  ")
+	}
+	buf.WriteString("]\n}\n")
+	return buf.Bytes(), nil
+}
+
+func encodeHCLExport(ex *ExportFile) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "version = %d\n", ex.Version)
+	for _, es := range ex.Services {
+		fields := exportFields(es)
+		width := 0
+		for _, f := range fields {
+			if len(f.Name) > width {
+				width = len(f.Name)
+			}
+		}
+		buf.WriteString("\nservice {\n")
+		for _, f := range fields {
+			fmt.Fprintf(&buf, "  %-*s = %s\n", width, f.Name, hclValue(f.Value))
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.Bytes(), nil
+}
+
+//hclValue formats a string, a number or a list of strings. Their JSON
+//encoding is valid HCL.
+func hclValue(v interface{}) string {
+	if l, ok := v.([]string); ok {
+		var quoted []string
+		for _, s := range l {
+			b, _ := marshalJSON(s)
+			quoted = append(quoted, string(b))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	b, _ := marshalJSON(v)
+	return string(b)
+}
+
+func encodeCSVExport(ex *ExportFile) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvColumns)
+	for _, es := range ex.Services {
+		d := &es.Definition
+		w.Write([]string{es.Node, es.Service, d.Address, strconv.Itoa(d.Port), d.Command, d.CheckType, d.Interval, d.TargetState, strings.Join(d.Tags, ";")})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+//decodeExport decodes an export file of any format and version into the keys
+//it holds and their JSON values, and returns the version of the file. The
+//values of versioned files are built from the fields of every service as
+//written, so they can still be checked for unknown fields.
+func decodeExport(data []byte, format string) ([]BackupKV, int, error) {
+	var services []map[string]interface{}
+	version := ExportVersion
+	switch format {
+	case FormatJSON:
+		var ex struct {
+			Version  int                      `json:"version"`
+			Services []map[string]interface{} `json:"services"`
+		}
+		if err := json.Unmarshal(data, &ex); err != nil {
+			return nil, 0, err
+		}
+		version, services = ex.Version, ex.Services
+	case FormatHCL:
+		var err error
+		if version, services, err = decodeHCLServices(data); err != nil {
+			return nil, 0, err
+		}
+	case FormatCSV:
+		var err error
+		if services, err = decodeCSVServices(data); err != nil {
+			return nil, 0, err
+		}
+	default:
+		var probe interface{}
+		if err := yaml.Unmarshal(data, &probe); err != nil {
+			return nil, 0, err
+		}
+		if _, ok := probe.(map[interface{}]interface{}); !ok {
+			var kv []BackupKV
+			err := yaml.Unmarshal(data, &kv)
+			return kv, 1, err
+		}
+		var ex struct {
+			Version  int                      `yaml:"version"`
+			Services []map[string]interface{} `yaml:"services"`
+		}
+		if err := yaml.Unmarshal(data, &ex); err != nil {
+			return nil, 0, err
+		}
+		version, services = ex.Version, ex.Services
+	}
+	if version != ExportVersion {
+		return nil, 0, fmt.Errorf("unsupported export version %d", version)
+	}
+
+	var kv []BackupKV
+	for _, s := range services {
+		node, _ := s["node"].(string)
+		service, _ := s["service"].(string)
+		delete(s, "node")
+		delete(s, "service")
+		b, err := json.Marshal(s)
+		if err != nil {
+			return nil, 0, fmt.Errorf("service %s/%s: %v", node, service, err)
+		}
+		kv = append(kv, BackupKV{Key: fmt.Sprintf("ExternalServices/%s/%s", node, service), Value: string(b)})
+	}
+	return kv, version, nil
+}
+
+//decodeHCLServices decodes the version and the service blocks of an HCL
+//export file. Every block is decoded on its own, as decoding them together
+//splits their attributes into separate maps.
+func decodeHCLServices(data []byte) (int, []map[string]interface{}, error) {
+	f, err := hcl.Parse(string(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	var ex struct {
+		Version int `hcl:"version"`
+	}
+	if err := hcl.DecodeObject(&ex, f); err != nil {
+		return 0, nil, err
+	}
+	list, ok := f.Node.(*ast.ObjectList)
+	if !ok {
+		return 0, nil, fmt.Errorf("expected version and service blocks")
+	}
+	var services []map[string]interface{}
+	for _, item := range list.Filter("service").Items {
+		var s map[string]interface{}
+		if err := hcl.DecodeObject(&s, item.Val); err != nil {
+			return 0, nil, err
+		}
+		services = append(services, s)
+	}
+	return ex.Version, services, nil
+}
+
+//decodeCSVServices decodes the rows of a CSV export file. Empty cells are
+//left out, numeric ports are converted and tags are split at ';'.
+func decodeCSVServices(data []byte) ([]map[string]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	var services []map[string]interface{}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := make(map[string]interface{})
+		for i, cell := range row {
+			cell = strings.TrimSpace(cell)
+			if cell == "" {
+				continue
+			}
+			switch header[i] {
+			case "port":
+				if n, err := strconv.Atoi(cell); err == nil {
+					s["port"] = n
+					continue
+				}
+			case "tags":
+				var tags []string
+				for _, t := range strings.Split(cell, ";") {
+					tags = append(tags, strings.TrimSpace(t))
+				}
+				s["tags"] = tags
+				continue
+			}
+			s[header[i]] = cell
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+var (
+	listItemLine = regexp.MustCompile(`^(\s*)-\s`)
+	hclBlockLine = regexp.MustCompile(`^\s*service\s*\{`)
+)
+
+//entryLines returns the line numbers where the services of a versioned
+//export file in format start, or nil if they cannot be told.
+func entryLines(data []byte, format string) []int {
+	var lines []int
+	switch format {
+	case FormatHCL:
+		for i, l := range strings.Split(string(data), "\n") {
+			if hclBlockLine.MatchString(l) {
+				lines = append(lines, i+1)
+			}
+		}
+	case FormatJSON:
+		lines = jsonServiceLines(data)
+	case FormatCSV:
+		//Rows are one per line unless a quoted cell spans several.
+		for i := range strings.Split(strings.TrimRight(string(data), "\n"), "\n")[1:] {
+			lines = append(lines, i+2)
+		}
+	case FormatYAML:
+		lines = serviceLines(data)
+	}
+	return lines
+}
+
+//jsonServiceLines returns the line numbers where the objects of the
+//top-level "services" array of a JSON export file start.
+func jsonServiceLines(data []byte) []int {
+	var lines []int
+	line, depth := 1, 0
+	inString, escaped := false, false
+	var str []byte
+	last, key := "", ""
+	inServices := false
+	for _, c := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+				str = append(str, c)
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString, last = false, string(str)
+			default:
+				str = append(str, c)
+			}
+			continue
+		}
+		switch c {
+		case '\n':
+			line++
+		case '"':
+			inString, str = true, str[:0]
+		case ':':
+			if depth == 1 {
+				key = last
+			}
+		case '{', '[':
+			depth++
+			if c == '[' && depth == 2 && key == "services" {
+				inServices = true
+			}
+			if c == '{' && depth == 3 && inServices {
+				lines = append(lines, line)
+			}
+		case '}', ']':
+			if depth == 2 {
+				inServices = false
+			}
+			depth--
+		}
+	}
+	return lines
+}
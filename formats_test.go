@@ -0,0 +1,54 @@
+package consul_externalservice
+
+import (
+	. "github.com/franela/goblin"
+	"strings"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("export formats", func() {
+		ex := &ExportFile{Version: ExportVersion, Services: []*ExportedService{
+			{Node: "node1", Service: "web", Definition: ExternalServiceDefinition{Address: "localhost", Port: 80, Command: `curl -s "http://localhost/", -f && test -d /tmp > /dev/null 2>&1`, Interval: "1s", TargetState: "running", Tags: []string{"http", "public"}}},
+			{Node: "node1", Service: "db", Definition: ExternalServiceDefinition{Address: "db", Interval: "10s", TargetState: "stopped", CheckType: CheckTTL}},
+		}}
+
+		g.It("are chosen by extension", func() {
+			g.Assert(FormatFromFileName("services.JSON")).Equal(FormatJSON)
+			g.Assert(FormatFromFileName("services.hcl")).Equal(FormatHCL)
+			g.Assert(FormatFromFileName("services.csv")).Equal(FormatCSV)
+			g.Assert(FormatFromFileName("services.yml")).Equal(FormatYAML)
+		})
+
+		g.It("round trip every definition", func() {
+			for _, format := range []string{FormatYAML, FormatJSON, FormatHCL, FormatCSV} {
+				data, err := encodeExport(ex, format)
+				g.Assert(err == nil).IsTrue()
+				defs, problems := parseDefinitionsFormat("services", data, format)
+				g.Assert(len(problems)).Equal(0)
+				g.Assert(len(defs)).Equal(2)
+				g.Assert(defs[0].Service).Equal("web")
+				g.Assert(len(DiffDefinitions(&ex.Services[0].Definition, defs[0].Definition))).Equal(0)
+				g.Assert(len(DiffDefinitions(&ex.Services[1].Definition, defs[1].Definition))).Equal(0)
+				if format == FormatJSON || format == FormatHCL {
+					g.Assert(strings.Contains(string(data), "&& test -d /tmp > /dev/null")).IsTrue()
+				}
+			}
+		})
+
+		g.It("report the lines of JSON problems", func() {
+			data := []byte("{\n  \"version\": 2,\n  \"services\": [\n    {\"node\": \"node1\", \"service\": \"web\", \"address\": \"a[{\", \"interval\": \"1s\", \"targetstate\": \"running\", \"checktype\": \"ttl\"},\n    {\n      \"node\": \"node1\",\n      \"service\": \"db\",\n      \"address\": \"db\",\n      \"interval\": \"1s\",\n      \"targetstate\": \"sleeping\",\n      \"checktype\": \"ttl\"\n    }\n  ]\n}\n")
+			_, problems := parseDefinitionsFormat("services.json", data, FormatJSON)
+			g.Assert(len(problems)).Equal(1)
+			g.Assert(problems[0].Line).Equal(5)
+		})
+
+		g.It("report problems with the same validation", func() {
+			data := []byte("node,service,address,port,interval,targetstate,command,owner\nnode1,web,localhost,eighty,1s,running,true,ops\n")
+			_, problems := parseDefinitionsFormat("services.csv", data, FormatCSV)
+			g.Assert(len(problems)).Equal(2)
+			g.Assert(problems[0].String()).Equal(`services.csv:2: ExternalServices/node1/web: unknown field "owner"`)
+		})
+	})
+}
@@ -0,0 +1,201 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/armon/consul-api"
+	"io/ioutil"
+	"sort"
+)
+
+//Actions of a PlanEntry.
+const (
+	PlanCreate    = "create"
+	PlanUpdate    = "update"
+	PlanUnchanged = "unchanged"
+	PlanDelete    = "delete"
+)
+
+//NamedDefinition is a definition together with the node and service it
+//belongs to.
+type NamedDefinition struct {
+	Node       string
+	Service    string
+	Definition *ExternalServiceDefinition
+}
+
+//Key returns the consul key of the definition.
+func (nd *NamedDefinition) Key() string {
+	return fmt.Sprintf("ExternalServices/%s/%s", nd.Node, nd.Service)
+}
+
+//PlanEntry is the action needed to bring the definition of a service in
+//consul (Current) in line with the desired one. Deleted services have a nil
+//Desired definition: applying the entry sets their TargetState to "deleted"
+//so their watcher deregisters them before removing the definition.
+type PlanEntry struct {
+	Node    string
+	Service string
+	Action  string
+	Current *ExternalServiceDefinition
+	Desired *ExternalServiceDefinition
+	Diffs   []FieldDiff
+	index   uint64
+}
+
+//Plan is the list of entries computed by PlanExternalServices, sorted by
+//node and service.
+type Plan []*PlanEntry
+
+//Count returns the number of entries of the plan with action.
+func (p Plan) Count(action string) int {
+	n := 0
+	for _, e := range p {
+		if e.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+//Changes reports whether applying the plan would change anything.
+func (p Plan) Changes() bool {
+	return len(p) > p.Count(PlanUnchanged)
+}
+
+func (p Plan) Len() int      { return len(p) }
+func (p Plan) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p Plan) Less(i, j int) bool {
+	if p[i].Node != p[j].Node {
+		return p[i].Node < p[j].Node
+	}
+	return p[i].Service < p[j].Service
+}
+
+//ReadDefinitionsFile reads and validates the definitions of an export file.
+//It fails with every problem found if any definition is not valid.
+func ReadDefinitionsFile(fileName string) ([]*NamedDefinition, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defs, problems := parseDefinitions(fileName, data)
+	if len(problems) > 0 {
+		var errs ValidationErrors
+		for _, p := range problems {
+			errs = append(errs, p.String())
+		}
+		return nil, errs
+	}
+	return defs, nil
+}
+
+//PruneNodes returns a prune function for PlanExternalServices that prunes
+//nodes, or every node when none is given.
+func PruneNodes(nodes ...string) func(node string) bool {
+	pruned := make(map[string]bool)
+	for _, n := range nodes {
+		pruned[n] = true
+	}
+	return func(node string) bool {
+		return len(pruned) == 0 || pruned[node]
+	}
+}
+
+//PruneNodesOf returns a prune function for PlanExternalServices that prunes
+//the nodes of defs, so other nodes are left alone.
+func PruneNodesOf(defs []*NamedDefinition) func(node string) bool {
+	var nodes []string
+	for _, nd := range defs {
+		nodes = append(nodes, nd.Node)
+	}
+	if len(nodes) == 0 {
+		return func(string) bool { return false }
+	}
+	return PruneNodes(nodes...)
+}
+
+//PlanExternalServices compares the desired definitions with the ones stored
+//in consul. Services defined in consul but not desired are only planned for
+//deletion when prune is not nil, and only on the nodes it returns true for.
+func PlanExternalServices(client *Client, desired []*NamedDefinition, prune func(node string) bool) (Plan, error) {
+	kvp, _, err := client.KV().List("ExternalServices/", nil)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*consulapi.KVPair)
+	for _, a := range kvp {
+		if _, _, ok := parseServiceKey(a.Key); ok {
+			current[a.Key] = a
+		}
+	}
+
+	var plan Plan
+	wanted := make(map[string]bool)
+	for _, nd := range desired {
+		wanted[nd.Key()] = true
+		e := &PlanEntry{Node: nd.Node, Service: nd.Service, Desired: nd.Definition}
+		a, ok := current[nd.Key()]
+		if !ok {
+			e.Action = PlanCreate
+			e.Diffs = DiffDefinitions(nil, nd.Definition)
+			plan = append(plan, e)
+			continue
+		}
+		var esd ExternalServiceDefinition
+		if err := json.Unmarshal(a.Value, &esd); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", a.Key, err)
+		}
+		e.Current, e.index = &esd, a.ModifyIndex
+		e.Diffs = DiffDefinitions(&esd, nd.Definition)
+		e.Action = PlanUpdate
+		if len(e.Diffs) == 0 {
+			e.Action = PlanUnchanged
+		}
+		plan = append(plan, e)
+	}
+
+	if prune != nil {
+		for key, a := range current {
+			node, service, _ := parseServiceKey(key)
+			if wanted[key] || !prune(node) {
+				continue
+			}
+			var esd ExternalServiceDefinition
+			if err := json.Unmarshal(a.Value, &esd); err != nil {
+				return nil, fmt.Errorf("decoding %s: %v", a.Key, err)
+			}
+			if esd.TargetState == "deleted" {
+				continue
+			}
+			plan = append(plan, &PlanEntry{Node: node, Service: service, Action: PlanDelete, Current: &esd, index: a.ModifyIndex})
+		}
+	}
+	sort.Sort(plan)
+	return plan, nil
+}
+
+//ApplyPlan applies the entries of plan in order with check-and-set writes,
+//so definitions changed since the plan was computed are not overwritten. It
+//stops at the first error and returns the number of entries applied.
+func ApplyPlan(client *Client, plan Plan) (int, error) {
+	applied := 0
+	for _, e := range plan {
+		var err error
+		switch e.Action {
+		case PlanCreate, PlanUpdate:
+			err = NewExternalServiceFromDefinition(client, e.Service, e.Node, e.Desired).SaveCAS(e.index)
+		case PlanDelete:
+			esd := *e.Current
+			esd.TargetState = "deleted"
+			err = NewExternalServiceFromDefinition(client, e.Service, e.Node, &esd).SaveCAS(e.index)
+		default:
+			continue
+		}
+		if err != nil {
+			return applied, fmt.Errorf("%s %s/%s: %v", e.Action, e.Node, e.Service, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
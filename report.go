@@ -0,0 +1,141 @@
+package consul_externalservice
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+//AvailabilityReport summarizes the availability of a service, or of every
+//service of a node when Service is empty, over the window [From, To).
+//Only the time the check was known to be running counts as Monitored, and
+//an outage is a period during which the check was "critical".
+type AvailabilityReport struct {
+	Node          string
+	Service       string
+	From          time.Time
+	To            time.Time
+	Monitored     time.Duration
+	Downtime      time.Duration
+	Outages       int
+	LongestOutage time.Duration
+}
+
+//Uptime returns the percentage of the monitored time the service was not
+//in an outage, or NaN if it was never monitored during the window.
+func (r *AvailabilityReport) Uptime() float64 {
+	if r.Monitored == 0 {
+		return math.NaN()
+	}
+	return float64(r.Monitored-r.Downtime) / float64(r.Monitored) * 100
+}
+
+//MTTR returns the mean time to recovery of the outages in the window.
+func (r *AvailabilityReport) MTTR() time.Duration {
+	if r.Outages == 0 {
+		return 0
+	}
+	return r.Downtime / time.Duration(r.Outages)
+}
+
+func isMonitored(status string) bool {
+	return status == "passing" || status == "warning" || status == "critical"
+}
+
+//ComputeAvailability builds the AvailabilityReport of a service from its
+//transitions, which must be sorted by time. Transitions before from are
+//only used to know the status at the beginning of the window.
+func ComputeAvailability(node, service string, transitions []*Transition, from, to time.Time) *AvailabilityReport {
+	r := &AvailabilityReport{Node: node, Service: service, From: from, To: to}
+	status := ""
+	outage := time.Duration(0)
+	cursor := from
+
+	account := func(until time.Time) {
+		if !until.After(cursor) {
+			return
+		}
+		d := until.Sub(cursor)
+		if isMonitored(status) {
+			r.Monitored += d
+		}
+		if status == "critical" {
+			r.Downtime += d
+			outage += d
+			if outage > r.LongestOutage {
+				r.LongestOutage = outage
+			}
+		}
+		cursor = until
+	}
+
+	i := 0
+	for ; i < len(transitions) && !transitions[i].Time.After(from); i++ {
+		status = transitions[i].To
+	}
+	if status == "critical" {
+		//the window begins in the middle of an outage
+		r.Outages++
+	}
+	for ; i < len(transitions) && transitions[i].Time.Before(to); i++ {
+		t := transitions[i]
+		account(t.Time)
+		if t.To == "critical" && status != "critical" {
+			r.Outages++
+			outage = 0
+		}
+		status = t.To
+	}
+	account(to)
+	return r
+}
+
+//NodeAvailability aggregates the reports of the services of a node into a
+//single report with an empty Service.
+func NodeAvailability(node string, services []*AvailabilityReport) *AvailabilityReport {
+	r := &AvailabilityReport{Node: node}
+	for _, s := range services {
+		r.From, r.To = s.From, s.To
+		r.Monitored += s.Monitored
+		r.Downtime += s.Downtime
+		r.Outages += s.Outages
+		if s.LongestOutage > r.LongestOutage {
+			r.LongestOutage = s.LongestOutage
+		}
+	}
+	return r
+}
+
+//AvailabilityReports computes from the recorded transitions the report of
+//every service of node (of every node if node is empty) and the aggregated
+//report of every node, both sorted by node and service name.
+func AvailabilityReports(client *Client, node string, from, to time.Time) ([]*AvailabilityReport, []*AvailabilityReport, error) {
+	ts, err := ListTransitions(client, node, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	byService := make(map[string][]*Transition)
+	var keys []string
+	for _, t := range ts {
+		k := t.Node + "/" + t.Service
+		if _, ok := byService[k]; !ok {
+			keys = append(keys, k)
+		}
+		byService[k] = append(byService[k], t)
+	}
+	sort.Strings(keys)
+
+	var services, nodes []*AvailabilityReport
+	var current []*AvailabilityReport
+	for i, k := range keys {
+		t := byService[k][0]
+		r := ComputeAvailability(t.Node, t.Service, byService[k], from, to)
+		services = append(services, r)
+		current = append(current, r)
+		if i == len(keys)-1 || byService[keys[i+1]][0].Node != t.Node {
+			nodes = append(nodes, NodeAvailability(t.Node, current))
+			current = nil
+		}
+	}
+	return services, nodes, nil
+}
@@ -0,0 +1,66 @@
+package consul_externalservice
+
+import (
+	. "github.com/franela/goblin"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityReport(t *testing.T) {
+	g := Goblin(t)
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(100 * time.Hour)
+	at := func(h int, status string) *Transition {
+		return &Transition{Node: "node1", Service: "s1", To: status, Time: from.Add(time.Duration(h) * time.Hour)}
+	}
+
+	g.Describe("availability report", func() {
+		g.It("is fully available when always passing", func() {
+			r := ComputeAvailability("node1", "s1", []*Transition{at(-10, "passing")}, from, to)
+			g.Assert(r.Uptime()).Equal(100.0)
+			g.Assert(r.Outages).Equal(0)
+			g.Assert(r.Monitored).Equal(100 * time.Hour)
+		})
+
+		g.It("counts outages, MTTR and the longest outage", func() {
+			ts := []*Transition{at(-1, "passing"), at(10, "critical"), at(12, "passing"), at(50, "critical"), at(56, "passing")}
+			r := ComputeAvailability("node1", "s1", ts, from, to)
+			g.Assert(r.Outages).Equal(2)
+			g.Assert(r.Downtime).Equal(8 * time.Hour)
+			g.Assert(r.MTTR()).Equal(4 * time.Hour)
+			g.Assert(r.LongestOutage).Equal(6 * time.Hour)
+			g.Assert(r.Uptime()).Equal(92.0)
+		})
+
+		g.It("clips outages to the window", func() {
+			ts := []*Transition{at(-5, "critical"), at(5, "passing"), at(95, "critical")}
+			r := ComputeAvailability("node1", "s1", ts, from, to)
+			g.Assert(r.Outages).Equal(2)
+			g.Assert(r.Downtime).Equal(10 * time.Hour)
+			g.Assert(r.LongestOutage).Equal(5 * time.Hour)
+		})
+
+		g.It("does not count stopped time as monitored", func() {
+			ts := []*Transition{at(0, "passing"), at(50, StatusStopped)}
+			r := ComputeAvailability("node1", "s1", ts, from, to)
+			g.Assert(r.Monitored).Equal(50 * time.Hour)
+			g.Assert(r.Uptime()).Equal(100.0)
+		})
+
+		g.It("has no uptime when never monitored", func() {
+			r := ComputeAvailability("node1", "s1", []*Transition{at(0, StatusStopped)}, from, to)
+			g.Assert(r.Monitored).Equal(time.Duration(0))
+			g.Assert(math.IsNaN(r.Uptime())).IsTrue()
+		})
+
+		g.It("aggregates services by node", func() {
+			a := ComputeAvailability("node1", "s1", []*Transition{at(0, "passing"), at(10, "critical"), at(30, "passing")}, from, to)
+			b := ComputeAvailability("node1", "s2", []*Transition{at(0, "passing")}, from, to)
+			r := NodeAvailability("node1", []*AvailabilityReport{a, b})
+			g.Assert(r.Monitored).Equal(200 * time.Hour)
+			g.Assert(r.Outages).Equal(1)
+			g.Assert(r.Uptime()).Equal(90.0)
+		})
+	})
+}
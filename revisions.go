@@ -0,0 +1,182 @@
+package consul_externalservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+//RevisionsKept is the number of previous definitions kept for every
+//external service.
+var RevisionsKept = 10
+
+//Revision is a previous definition of an external service, replaced by
+//Author at Time. Revisions are stored under
+// /v1/kv/ExternalServicesRevisions/<node name>/<service name>/<number>.
+type Revision struct {
+	Number     int
+	Author     string
+	Time       time.Time
+	Definition *ExternalServiceDefinition
+}
+
+func revisionsPrefix(node, service string) string {
+	return fmt.Sprintf("ExternalServicesRevisions/%s/%s/", node, service)
+}
+
+func revisionKey(node, service string, number int) string {
+	return fmt.Sprintf("%s%010d", revisionsPrefix(node, service), number)
+}
+
+//revisionAuthor identifies who makes a change as the user and host running
+//the program.
+func revisionAuthor() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+//ListRevisions returns the revisions kept for a service, oldest first.
+func ListRevisions(client *Client, node, service string) ([]*Revision, error) {
+	kvp, _, err := client.KV().List(revisionsPrefix(node, service), nil)
+	if err != nil {
+		return nil, err
+	}
+	var revisions []*Revision
+	for _, a := range kvp {
+		var r Revision
+		if err := json.Unmarshal(a.Value, &r); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", a.Key, err)
+		}
+		revisions = append(revisions, &r)
+	}
+	return revisions, nil
+}
+
+//revisionWrites returns the writes creating, for every write of a
+//definition that replaces a different one, the revision keeping the
+//definition replaced. Revisions are created with check-and-set, so two
+//writers cannot take the same number, and are meant to be written in the
+//same transaction as the definitions, so the revision kept is exactly the
+//definition replaced. A definition deleted with a "deleted" target state is
+//kept stopped, so rolling back to it brings the service back instead of
+//deleting it again.
+func revisionWrites(client *Client, writes []*kvWrite) ([]*kvWrite, error) {
+	author, now := revisionAuthor(), time.Now()
+	next := make(map[string]int)
+	var revs []*kvWrite
+	for _, w := range writes {
+		node, service, ok := parseServiceKey(w.Key)
+		if !ok || w.Previous == nil || bytes.Equal(w.Previous.Value, w.Value) {
+			continue
+		}
+		var esd ExternalServiceDefinition
+		if err := json.Unmarshal(w.Previous.Value, &esd); err != nil {
+			//What is not a definition cannot be rolled back to.
+			continue
+		}
+		if w.Delete && esd.TargetState == "deleted" {
+			esd.TargetState = "stopped"
+		}
+		prefix := revisionsPrefix(node, service)
+		if _, ok := next[prefix]; !ok {
+			revisions, err := ListRevisions(client, node, service)
+			if err != nil {
+				return nil, err
+			}
+			next[prefix] = 1
+			if len(revisions) > 0 {
+				next[prefix] = revisions[len(revisions)-1].Number + 1
+			}
+		}
+		r := &Revision{Number: next[prefix], Author: author, Time: now, Definition: &esd}
+		next[prefix]++
+		b, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, &kvWrite{Key: revisionKey(node, service, r.Number), Value: b})
+	}
+	return revs, nil
+}
+
+//writeDefinitions writes definitions atomically together with the revisions
+//of the ones they replace, and then removes the revisions beyond
+//RevisionsKept. A *TxnError caused by a revision taken by a concurrent write
+//names the key of its definition.
+func writeDefinitions(client *Client, writes []*kvWrite) error {
+	revs, err := revisionWrites(client, writes)
+	if err != nil {
+		return err
+	}
+	all := append(append([]*kvWrite{}, writes...), revs...)
+	if err := writeKVAtomically(client, all); err != nil {
+		if te, ok := err.(*TxnError); ok && strings.HasPrefix(te.Key, "ExternalServicesRevisions/") {
+			parts := strings.Split(te.Key, "/")
+			te.Key = fmt.Sprintf("ExternalServices/%s/%s", parts[1], parts[2])
+			te.What = "revision taken by a concurrent write: " + te.What
+		}
+		return err
+	}
+	for _, w := range revs {
+		parts := strings.Split(w.Key, "/")
+		if err := pruneRevisions(client, parts[1], parts[2]); err != nil {
+			log.WithFields(log.Fields{"node": parts[1], "service": parts[2], "error": err}).Warn("Removing old revisions failed")
+		}
+	}
+	return nil
+}
+
+//pruneRevisions removes the oldest revisions of a service beyond
+//RevisionsKept.
+func pruneRevisions(client *Client, node, service string) error {
+	revisions, err := ListRevisions(client, node, service)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(revisions)-RevisionsKept; i++ {
+		if _, err := client.KV().Delete(revisionKey(node, service, revisions[i].Number), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//RollbackExternalService restores the definition of revision number of a
+//service and returns the differences with the definition it replaces. The
+//replaced definition is kept as a new revision, so a rollback can be rolled
+//back too.
+func RollbackExternalService(client *Client, node, service string, number int) ([]FieldDiff, error) {
+	kvp, _, err := client.KV().Get(revisionKey(node, service, number), nil)
+	if err != nil {
+		return nil, err
+	}
+	if kvp == nil {
+		return nil, fmt.Errorf("no revision %d of %s/%s", number, node, service)
+	}
+	var r Revision
+	if err := json.Unmarshal(kvp.Value, &r); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", kvp.Key, err)
+	}
+	current, index, err := LoadExternalService(client, service, node)
+	if err != nil {
+		return nil, err
+	}
+	var old *ExternalServiceDefinition
+	if current != nil {
+		old = current.Definition()
+	}
+	diffs := DiffDefinitions(old, r.Definition)
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+	return diffs, NewExternalServiceFromDefinition(client, service, node, r.Definition).SaveCAS(index)
+}
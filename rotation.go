@@ -0,0 +1,148 @@
+package consul_externalservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Names of timestamped backups are backupPrefix, the time in backupTimeFormat
+//(UTC) and the extension of their format. Their checksum is stored beside
+//them with ChecksumSuffix appended, in the format of sha256sum.
+const (
+	backupPrefix     = "externalservices-"
+	backupTimeFormat = "20060102T150405Z"
+	ChecksumSuffix   = ".sha256"
+)
+
+//BackupRetention decides which timestamped backups are kept: the Keep most
+//recent ones and the ones younger than MaxAge. A zero field does not keep
+//anything on its own and if both are zero every backup is kept. The most
+//recent backup is always kept.
+type BackupRetention struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+//WriteTimestampedBackup exports every definition in format to a new file of
+//dir named after now, together with its checksum file, and returns the name
+//of the backup. Both files are written atomically, only readable by their
+//owner. If enc is set the backup is encrypted and named with EncryptedSuffix.
+func WriteTimestampedBackup(client *Client, dir, format string, enc *Encryption, now time.Time) (string, error) {
+	if format == "" {
+		format = FormatYAML
+	}
+	if _, err := resolveFormat("", format); err != nil {
+		return "", err
+	}
+	ex, err := exportExternalServices(client, Filter{})
+	if err != nil {
+		return "", err
+	}
+	data, err := encodeExport(ex, format)
+	if err != nil {
+		return "", err
+	}
+	fileName := filepath.Join(dir, backupPrefix+now.UTC().Format(backupTimeFormat)+"."+format)
+	if enc != nil {
+		if data, err = enc.Encrypt(data); err != nil {
+			return "", err
+		}
+		fileName += EncryptedSuffix
+	}
+	if err := writeFileAtomic(fileName, data, 0600); err != nil {
+		return "", &FileError{Op: "writing", File: fileName, Err: err}
+	}
+	sum := sha256.Sum256(data)
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), filepath.Base(fileName))
+	if err := writeFileAtomic(fileName+ChecksumSuffix, []byte(line), 0600); err != nil {
+		return "", &FileError{Op: "writing", File: fileName + ChecksumSuffix, Err: err}
+	}
+	return fileName, nil
+}
+
+//VerifyBackup checks fileName against its checksum file.
+func VerifyBackup(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	line, err := ioutil.ReadFile(fileName + ChecksumSuffix)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(line))
+	sum := sha256.Sum256(data)
+	if len(fields) == 0 || fields[0] != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("%s does not match its checksum", fileName)
+	}
+	return nil
+}
+
+//timestampedBackup is a backup found in a directory.
+type timestampedBackup struct {
+	name string
+	time time.Time
+}
+
+type byBackupTime []timestampedBackup
+
+func (b byBackupTime) Len() int           { return len(b) }
+func (b byBackupTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byBackupTime) Less(i, j int) bool { return b[i].time.After(b[j].time) }
+
+//listBackups returns the timestamped backups of dir, most recent first.
+func listBackups(dir string) ([]timestampedBackup, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []timestampedBackup
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, backupPrefix) || strings.HasSuffix(name, ChecksumSuffix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, backupPrefix)
+		if i := strings.Index(stamp, "."); i >= 0 {
+			stamp = stamp[:i]
+		}
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, timestampedBackup{name: filepath.Join(dir, name), time: t})
+	}
+	sort.Sort(byBackupTime(backups))
+	return backups, nil
+}
+
+//RotateBackups removes the timestamped backups of dir, and their checksum
+//files, not kept by retention and returns their names.
+func RotateBackups(dir string, retention BackupRetention, now time.Time) ([]string, error) {
+	if retention.Keep <= 0 && retention.MaxAge <= 0 {
+		return nil, nil
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for i, b := range backups {
+		if i == 0 || i < retention.Keep || (retention.MaxAge > 0 && now.Sub(b.time) < retention.MaxAge) {
+			continue
+		}
+		if err := os.Remove(b.name); err != nil {
+			return removed, err
+		}
+		os.Remove(b.name + ChecksumSuffix)
+		removed = append(removed, b.name)
+	}
+	return removed, nil
+}
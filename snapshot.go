@@ -0,0 +1,272 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/armon/consul-api"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+//SnapshotVersion is the version of the snapshot format.
+const SnapshotVersion = 1
+
+//Snapshot captures everything needed to bring the external services back on
+//a fresh cluster: their definitions, the catalog entries of the external
+//nodes, the checks named check:<service>:<node> and the watchers holding the
+//lock of every node.
+type Snapshot struct {
+	Version  int                `yaml:"version"`
+	Taken    time.Time          `yaml:"taken"`
+	Services []*ExportedService `yaml:"services"`
+	Catalog  []*SnapshotNode    `yaml:"catalog"`
+	Checks   []*SnapshotCheck   `yaml:"checks"`
+	Watchers []*SnapshotWatcher `yaml:"watchers"`
+}
+
+//SnapshotNode is the catalog entry of an external node.
+type SnapshotNode struct {
+	Node     string                    `yaml:"node"`
+	Address  string                    `yaml:"address"`
+	Services []*consulapi.AgentService `yaml:"services"`
+}
+
+//SnapshotCheck is the state of the check of an external service on the
+//agent that ran it.
+type SnapshotCheck struct {
+	Name   string `yaml:"name"`
+	Agent  string `yaml:"agent"`
+	Status string `yaml:"status"`
+	Output string `yaml:"output,omitempty"`
+}
+
+//SnapshotWatcher is the consul node whose watcher held the lock of an
+//external node. Locks belong to sessions and are not restored; they are
+//recorded to know where the watchers ran.
+type SnapshotWatcher struct {
+	Node   string `yaml:"node"`
+	Holder string `yaml:"holder"`
+}
+
+//SnapshotRestoreSummary tells what RestoreSnapshot restored: the keys of
+//the definitions, the catalog services as <node>/<service id> and the checks.
+//Definitions that are not valid are listed in Invalid and neither they, nor
+//their catalog entries and checks, are restored. Catalog entries and checks
+//that could not be rebuilt are listed in Failed.
+type SnapshotRestoreSummary struct {
+	Definitions []string
+	Services    []string
+	Checks      []string
+	Invalid     []*KeyError
+	Failed      []*KeyError
+}
+
+//TakeSnapshot captures the definitions of every external service together
+//with the catalog, check and watcher state of their nodes.
+func TakeSnapshot(client *Client) (*Snapshot, error) {
+	ex, err := exportExternalServices(client, Filter{})
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{Version: SnapshotVersion, Taken: time.Now(), Services: ex.Services}
+
+	var nodes []string
+	seen := make(map[string]bool)
+	for _, es := range ex.Services {
+		if !seen[es.Node] {
+			seen[es.Node] = true
+			nodes = append(nodes, es.Node)
+		}
+	}
+	for _, node := range nodes {
+		cn, _, err := client.Catalog().Node(node, nil)
+		if err != nil {
+			return nil, err
+		}
+		if cn != nil && cn.Node != nil {
+			sn := &SnapshotNode{Node: node, Address: cn.Node.Address}
+			var ids []string
+			for id := range cn.Services {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				sn.Services = append(sn.Services, cn.Services[id])
+			}
+			snap.Catalog = append(snap.Catalog, sn)
+		}
+		holder, err := WatcherLeader(client, node)
+		if err != nil {
+			return nil, err
+		}
+		if holder != "" {
+			snap.Watchers = append(snap.Watchers, &SnapshotWatcher{Node: node, Holder: holder})
+		}
+	}
+
+	checks, _, err := client.Health().State("any", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range checks {
+		if parts := strings.Split(c.Name, ":"); len(parts) == 3 && parts[0] == "check" {
+			snap.Checks = append(snap.Checks, &SnapshotCheck{Name: c.Name, Agent: c.Node, Status: c.Status, Output: c.Output})
+		}
+	}
+	return snap, nil
+}
+
+//WriteSnapshot takes a snapshot and writes it to fileName, encrypted with enc
+//if set. The file is only readable by its owner.
+func WriteSnapshot(client *Client, fileName string, enc *Encryption) (*Snapshot, error) {
+	snap, err := TakeSnapshot(client)
+	if err != nil {
+		return nil, err
+	}
+	data, err := yaml.Marshal(snap)
+	if err != nil {
+		return nil, &FileError{Op: "encoding", File: fileName, Err: err}
+	}
+	if enc != nil {
+		if data, err = enc.Encrypt(data); err != nil {
+			return nil, &FileError{Op: "encrypting", File: fileName, Err: err}
+		}
+	}
+	if err := writeFileAtomic(fileName, data, 0600); err != nil {
+		return nil, &FileError{Op: "writing", File: fileName, Err: err}
+	}
+	return snap, nil
+}
+
+//ReadSnapshot reads a snapshot written by WriteSnapshot, decrypting it with
+//enc if it is encrypted.
+func ReadSnapshot(fileName string, enc *Encryption) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, &FileError{Op: "reading", File: fileName, Err: err}
+	}
+	if data, err = decryptBackup(data, enc); err != nil {
+		return nil, &FileError{Op: "decrypting", File: fileName, Err: err}
+	}
+	var snap Snapshot
+	if err := yaml.Unmarshal(data, &snap); err != nil {
+		return nil, &FileError{Op: "decoding", File: fileName, Err: err}
+	}
+	if snap.Version != SnapshotVersion {
+		return nil, &FileError{Op: "decoding", File: fileName, Err: fmt.Errorf("unsupported snapshot version %d", snap.Version)}
+	}
+	return &snap, nil
+}
+
+//RestoreSnapshot writes the valid definitions of snap to consul, all or
+//none, overwriting the ones that exist. With rebuild it also registers the
+//catalog entries of the external nodes and, on the agent of client, the
+//checks of the services, so they are back before any watcher starts. The
+//status of TTL checks is restored too; script checks run on their own.
+//Rebuilding goes on after a failure, as nothing can be rolled back, and the
+//summary tells what was rebuilt and what failed.
+func RestoreSnapshot(client *Client, snap *Snapshot, rebuild bool) (*SnapshotRestoreSummary, error) {
+	summary := &SnapshotRestoreSummary{}
+	kvp, _, err := client.KV().List("ExternalServices/", nil)
+	if err != nil {
+		return summary, fmt.Errorf("listing external services: %v", err)
+	}
+	current := make(map[string]*consulapi.KVPair)
+	for _, a := range kvp {
+		current[a.Key] = a
+	}
+	var writes []*kvWrite
+	var services []*ExportedService
+	for _, es := range snap.Services {
+		nd := &NamedDefinition{Node: es.Node, Service: es.Service, Definition: &es.Definition}
+		if err := es.Definition.Validate(); err != nil {
+			summary.Invalid = append(summary.Invalid, &KeyError{Key: nd.Key(), Err: err})
+			continue
+		}
+		value, err := json.Marshal(nd.Definition)
+		if err != nil {
+			summary.Invalid = append(summary.Invalid, &KeyError{Key: nd.Key(), Err: err})
+			continue
+		}
+		w := &kvWrite{Key: nd.Key(), Value: value}
+		if prev := current[nd.Key()]; prev != nil {
+			w.Index, w.Previous = prev.ModifyIndex, prev
+		}
+		writes = append(writes, w)
+		services = append(services, es)
+	}
+	if err := writeDefinitions(client, writes); err != nil {
+		return summary, err
+	}
+	for _, w := range writes {
+		summary.Definitions = append(summary.Definitions, w.Key)
+	}
+	if !rebuild {
+		return summary, nil
+	}
+
+	restored := make(map[string]bool)
+	for _, es := range services {
+		restored[es.Node+"/"+es.Service] = true
+	}
+	fail := func(key string, err error) {
+		summary.Failed = append(summary.Failed, &KeyError{Key: key, Err: err})
+	}
+	for _, sn := range snap.Catalog {
+		for _, s := range sn.Services {
+			key := sn.Node + "/" + s.ID
+			if !restored[key] {
+				continue
+			}
+			_, err := client.Catalog().Register(&consulapi.CatalogRegistration{Node: sn.Node, Address: sn.Address, Service: s}, nil)
+			if err != nil {
+				fail(key, fmt.Errorf("registering: %v", err))
+				continue
+			}
+			summary.Services = append(summary.Services, key)
+		}
+	}
+
+	statuses := make(map[string]string)
+	for _, c := range snap.Checks {
+		statuses[c.Name] = c.Status
+	}
+	for _, es := range services {
+		name := fmt.Sprintf("check:%s:%s", es.Service, es.Node)
+		status, ok := statuses[name]
+		if !ok {
+			continue
+		}
+		s := NewExternalServiceFromDefinition(client, es.Service, es.Node, &es.Definition)
+		if s.CheckExists() {
+			continue
+		}
+		if err := s.registerCheck(); err != nil {
+			fail(name, fmt.Errorf("registering: %v", err))
+			continue
+		}
+		if es.Definition.CheckType == CheckTTL {
+			note := "restored from snapshot"
+			switch status {
+			case "passing":
+				err = client.Agent().PassTTL(name, note)
+			case "warning":
+				err = client.Agent().WarnTTL(name, note)
+			default:
+				err = client.Agent().FailTTL(name, note)
+			}
+			if err != nil {
+				fail(name, fmt.Errorf("setting %s: %v", status, err))
+				continue
+			}
+		}
+		summary.Checks = append(summary.Checks, name)
+	}
+	if len(summary.Failed) > 0 {
+		return summary, fmt.Errorf("%d catalog entries and checks not rebuilt", len(summary.Failed))
+	}
+	return summary, nil
+}
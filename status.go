@@ -0,0 +1,137 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/armon/consul-api"
+	"strings"
+)
+
+//ExternalServiceStatus is a snapshot of an external service: its definition
+//together with its catalog registration and the state of its check.
+type ExternalServiceStatus struct {
+	Node        string
+	Service     string
+	Definition  *ExternalServiceDefinition
+	Registered  bool
+	CheckStatus string
+	CheckOutput string
+	Transitions []*Transition
+}
+
+func (es *ExternalService) Node() string {
+	return es.node
+}
+
+func (es *ExternalService) Service() string {
+	return es.service
+}
+
+//Definition returns the definition of es. Changes made to it are stored by
+//Save.
+func (es *ExternalService) Definition() *ExternalServiceDefinition {
+	return es.definition
+}
+
+//parseServiceKey splits an ExternalServices/<node>/<service> key.
+func parseServiceKey(key string) (string, string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || parts[0] != "ExternalServices" || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+//ListExternalServices returns every external service defined for node, or
+//for every node if node is empty, sorted by node and service name.
+func ListExternalServices(client *Client, node string) ([]*ExternalService, error) {
+	prefix := "ExternalServices/"
+	if node != "" {
+		prefix += node + "/"
+	}
+	kvp, _, err := client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	var services []*ExternalService
+	for _, a := range kvp {
+		n, s, ok := parseServiceKey(a.Key)
+		if !ok {
+			continue
+		}
+		var esd ExternalServiceDefinition
+		if err := json.Unmarshal(a.Value, &esd); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", a.Key, err)
+		}
+		services = append(services, &ExternalService{service: s, node: n, definition: &esd, client: client})
+	}
+	return services, nil
+}
+
+//ExternalServicesStatus returns the status of every external service defined
+//for node, or for every node if node is empty, with at most transitions of
+//their most recent transitions.
+func ExternalServicesStatus(client *Client, node string, transitions int) ([]*ExternalServiceStatus, error) {
+	services, err := ListExternalServices(client, node)
+	if err != nil {
+		return nil, err
+	}
+	checks, _, err := client.Health().State("any", nil)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*consulapi.HealthCheck)
+	for _, c := range checks {
+		byName[c.Name] = c
+	}
+	ts, err := ListTransitions(client, node, "")
+	if err != nil {
+		return nil, err
+	}
+	byService := make(map[string][]*Transition)
+	for _, t := range ts {
+		k := t.Node + "/" + t.Service
+		byService[k] = append(byService[k], t)
+	}
+	catalog := make(map[string]*consulapi.CatalogNode)
+
+	var statuses []*ExternalServiceStatus
+	for _, es := range services {
+		cn, ok := catalog[es.node]
+		if !ok {
+			cn, _, err = client.Catalog().Node(es.node, nil)
+			if err != nil {
+				return nil, err
+			}
+			catalog[es.node] = cn
+		}
+		st := &ExternalServiceStatus{Node: es.node, Service: es.service, Definition: es.definition, CheckStatus: "unknown"}
+		if cn != nil && cn.Services[es.service] != nil {
+			st.Registered = true
+		}
+		if c := byName[fmt.Sprintf("check:%s:%s", es.service, es.node)]; c != nil {
+			st.CheckStatus = c.Status
+			st.CheckOutput = c.Output
+		}
+		st.Transitions = byService[es.node+"/"+es.service]
+		if len(st.Transitions) > transitions {
+			st.Transitions = st.Transitions[len(st.Transitions)-transitions:]
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+//WatcherLeader returns the name of the consul node running the watcher that
+//currently leads node, or an empty string if no watcher holds its lock.
+func WatcherLeader(client *Client, node string) (string, error) {
+	kvp, _, err := client.KV().Get(fmt.Sprintf("ExternalServicesWatchers/%s", node), nil)
+	if err != nil || kvp == nil || kvp.Session == "" {
+		return "", err
+	}
+	se, _, err := client.Session().Info(kvp.Session, nil)
+	if err != nil || se == nil {
+		return "", err
+	}
+	return se.Node, nil
+}
@@ -0,0 +1,121 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/armon/consul-api"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//TransitionRetention is how long recorded transitions are kept in consul's
+//KeyValue store before the watcher prunes them.
+var TransitionRetention = 400 * 24 * time.Hour
+
+//StatusStopped is recorded as the status of a service whose check has been
+//removed because its TargetState is no longer "running".
+const StatusStopped = "stopped"
+
+//Transition is a change in the check status of an external service as seen
+//by the leading watcher of its node. Transitions are stored under
+// /v1/kv/ExternalServicesTransitions/<node name>/<service name>/<timestamp>.
+type Transition struct {
+	Node    string
+	Service string
+	From    string
+	To      string
+	Time    time.Time
+}
+
+func transitionsPrefix(node, service string) string {
+	prefix := "ExternalServicesTransitions/"
+	if node != "" {
+		prefix += node + "/"
+		if service != "" {
+			prefix += service + "/"
+		}
+	}
+	return prefix
+}
+
+//RecordTransition stores t in consul and prunes the transitions of the same
+//service that are older than TransitionRetention.
+func RecordTransition(client *Client, t *Transition) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%020d", transitionsPrefix(t.Node, t.Service), t.Time.UnixNano())
+	_, err = client.KV().Put(&consulapi.KVPair{Key: key, Value: b}, nil)
+	if err != nil {
+		return err
+	}
+	return pruneTransitions(client, t.Node, t.Service, t.Time.Add(-TransitionRetention))
+}
+
+func pruneTransitions(client *Client, node, service string, before time.Time) error {
+	keys, _, err := client.KV().Keys(transitionsPrefix(node, service), "", nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		ts, err := strconv.ParseInt(k[strings.LastIndex(k, "/")+1:], 10, 64)
+		if err != nil || ts >= before.UnixNano() {
+			continue
+		}
+		if _, err := client.KV().Delete(k, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//LastTransition returns the most recent transition recorded for a service,
+//or nil if there is none.
+func LastTransition(client *Client, node, service string) (*Transition, error) {
+	keys, _, err := client.KV().Keys(transitionsPrefix(node, service), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Strings(keys)
+	kvp, _, err := client.KV().Get(keys[len(keys)-1], nil)
+	if err != nil || kvp == nil {
+		return nil, err
+	}
+	var t Transition
+	if err := json.Unmarshal(kvp.Value, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+//ListTransitions returns the recorded transitions ordered by time. An empty
+//node returns the transitions of every node and an empty service those of
+//every service of node.
+func ListTransitions(client *Client, node, service string) ([]*Transition, error) {
+	kvp, _, err := client.KV().List(transitionsPrefix(node, service), nil)
+	if err != nil {
+		return nil, err
+	}
+	var ts []*Transition
+	for _, a := range kvp {
+		var t Transition
+		if err := json.Unmarshal(a.Value, &t); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", a.Key, err)
+		}
+		ts = append(ts, &t)
+	}
+	sort.Sort(byTime(ts))
+	return ts, nil
+}
+
+type byTime []*Transition
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].Time.Before(a[j].Time) }
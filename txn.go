@@ -0,0 +1,236 @@
+package consul_externalservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/armon/consul-api"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+//txnMaxOps is the maximum number of operations consul accepts in a single
+//transaction.
+const txnMaxOps = 64
+
+//txnMaxBytes is the largest transaction request body sent, below the 512KB
+//consul accepts by default (txn_max_req_len).
+const txnMaxBytes = 512*1024 - 1024
+
+//kvTxnOp is a KV operation of a consul transaction.
+type kvTxnOp struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+	Index uint64 `json:",omitempty"`
+}
+
+//TxnError is returned when consul rolls back a transaction because one of
+//its operations failed.
+type TxnError struct {
+	Key  string
+	What string
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("transaction rolled back at %s: %s", e.Key, e.What)
+}
+
+//txnBatchEnd returns the end of the batch of ops that starts at start: at
+//most txnMaxOps operations whose encoding fits in txnMaxBytes, but at least
+//one so an operation too large is still sent and reported by consul.
+func txnBatchEnd(ops []*kvTxnOp, start int) int {
+	size, end := 2, start
+	for end < len(ops) && end-start < txnMaxOps {
+		b, _ := json.Marshal(map[string]*kvTxnOp{"KV": ops[end]})
+		size += len(b) + 1
+		if size > txnMaxBytes && end > start {
+			break
+		}
+		end++
+	}
+	return end
+}
+
+//kvTxn runs ops in a single transaction (consul 0.7 or later) and returns the
+//pairs written.
+func kvTxn(client *Client, ops []*kvTxnOp) ([]*consulapi.KVPair, error) {
+	config := client.config
+	var body []map[string]*kvTxnOp
+	for _, op := range ops {
+		body = append(body, map[string]*kvTxnOp{"KV": op})
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	u := &url.URL{Scheme: scheme, Host: config.Address, Path: "/v1/txn"}
+	q := url.Values{}
+	if config.Datacenter != "" {
+		q.Set("dc", config.Datacenter)
+	}
+	if config.Token != "" {
+		q.Set("token", config.Token)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if config.HttpAuth != nil {
+		req.SetBasicAuth(config.HttpAuth.Username, config.HttpAuth.Password)
+	}
+	httpClient := config.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return nil, fmt.Errorf("transaction failed: %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+
+	var result struct {
+		Results []struct {
+			KV *consulapi.KVPair
+		}
+		Errors []struct {
+			OpIndex int
+			What    string
+		}
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decoding transaction result: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		e := result.Errors[0]
+		key := ""
+		if e.OpIndex >= 0 && e.OpIndex < len(ops) {
+			key = ops[e.OpIndex].Key
+		}
+		return nil, &TxnError{Key: key, What: e.What}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("transaction failed: %s", resp.Status)
+	}
+	var pairs []*consulapi.KVPair
+	for _, r := range result.Results {
+		pairs = append(pairs, r.KV)
+	}
+	return pairs, nil
+}
+
+//RollbackError is returned when writing keys atomically fails and rolling
+//back the transactions already committed fails too. Committed lists the keys
+//that stay written.
+type RollbackError struct {
+	Err         error
+	RollbackErr error
+	Committed   []string
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%v; rolling back: %v, %d keys stay written", e.Err, e.RollbackErr, len(e.Committed))
+}
+
+//kvWrite is a key to write with check-and-set semantics: Index is the
+//ModifyIndex the key must still have, or 0 if it must not exist yet.
+//Previous is the pair it replaces, if any, used to roll the write back.
+//Delete deletes the key instead of writing Value.
+type kvWrite struct {
+	Key      string
+	Value    []byte
+	Index    uint64
+	Previous *consulapi.KVPair
+	Delete   bool
+}
+
+//writeKVAtomically writes every key in transactions of at most txnMaxOps
+//operations and txnMaxBytes. If one of them fails the ones already committed
+//are rolled back, so either every key is written or none is, unless the
+//rollback fails too and a *RollbackError is returned. Keys of committed
+//transactions can be read until they are rolled back.
+func writeKVAtomically(client *Client, writes []*kvWrite) error {
+	var ops []*kvTxnOp
+	for _, w := range writes {
+		op := &kvTxnOp{Verb: "cas", Key: w.Key, Value: w.Value, Index: w.Index}
+		if w.Delete {
+			op.Verb, op.Value = "delete-cas", nil
+		}
+		ops = append(ops, op)
+	}
+	var committed []*kvWrite
+	var written []*consulapi.KVPair
+	for start, end := 0, 0; start < len(ops); start = end {
+		end = txnBatchEnd(ops, start)
+		pairs, err := kvTxn(client, ops[start:end])
+		if err != nil {
+			if remaining, rerr := rollbackKV(client, committed, written); rerr != nil {
+				return &RollbackError{Err: err, RollbackErr: rerr, Committed: remaining}
+			}
+			return err
+		}
+		//Deletes have no result, so written is aligned with committed.
+		for _, w := range writes[start:end] {
+			committed = append(committed, w)
+			if w.Delete || len(pairs) == 0 {
+				written = append(written, nil)
+				continue
+			}
+			written, pairs = append(written, pairs[0]), pairs[1:]
+		}
+	}
+	return nil
+}
+
+//rollbackKV restores the previous value of the committed writes, deleted
+//keys included, or deletes the keys they created, as long as nobody changed
+//them since. If it fails it
+//returns the keys not rolled back.
+func rollbackKV(client *Client, committed []*kvWrite, written []*consulapi.KVPair) ([]string, error) {
+	var ops []*kvTxnOp
+	for i, w := range committed {
+		op := &kvTxnOp{Verb: "delete-cas", Key: w.Key}
+		if w.Previous != nil {
+			op.Verb, op.Value = "cas", w.Previous.Value
+		}
+		if w.Delete {
+			//With Index 0 a deleted key is only recreated if nobody did
+			//meanwhile.
+			if w.Previous == nil {
+				op.Verb = "delete"
+			}
+		} else if i < len(written) && written[i] != nil {
+			op.Index = written[i].ModifyIndex
+		} else if op.Verb == "cas" {
+			op.Verb = "set"
+		} else {
+			op.Verb = "delete"
+		}
+		ops = append(ops, op)
+	}
+	for start, end := 0, 0; start < len(ops); start = end {
+		end = txnBatchEnd(ops, start)
+		if _, err := kvTxn(client, ops[start:end]); err != nil {
+			var remaining []string
+			for _, w := range committed[start:] {
+				remaining = append(remaining, w.Key)
+			}
+			return remaining, err
+		}
+	}
+	return nil, nil
+}
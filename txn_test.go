@@ -0,0 +1,116 @@
+package consul_externalservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	consulapi "github.com/armon/consul-api"
+	. "github.com/franela/goblin"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("atomic writes", func() {
+		g.It("report the keys left written when the rollback fails", func() {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				var ops []map[string]*kvTxnOp
+				json.NewDecoder(r.Body).Decode(&ops)
+				switch calls {
+				case 1:
+					var results []map[string]*consulapi.KVPair
+					for i, op := range ops {
+						results = append(results, map[string]*consulapi.KVPair{"KV": {Key: op["KV"].Key, ModifyIndex: uint64(i + 1)}})
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+				case 2:
+					w.WriteHeader(http.StatusConflict)
+					fmt.Fprint(w, `{"Errors": [{"OpIndex": 0, "What": "index is stale"}]}`)
+				default:
+					http.Error(w, "unavailable", http.StatusInternalServerError)
+				}
+			}))
+			defer server.Close()
+
+			client, err := NewClient(&consulapi.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+			g.Assert(err == nil).IsTrue()
+			var writes []*kvWrite
+			for i := 0; i < txnMaxOps+1; i++ {
+				writes = append(writes, &kvWrite{Key: fmt.Sprintf("ExternalServices/node1/s%d", i), Value: []byte("{}")})
+			}
+			err = writeKVAtomically(client, writes)
+			re, ok := err.(*RollbackError)
+			g.Assert(ok).IsTrue()
+			g.Assert(len(re.Committed)).Equal(txnMaxOps)
+			te, ok := re.Err.(*TxnError)
+			g.Assert(ok).IsTrue()
+			g.Assert(te.Key).Equal(fmt.Sprintf("ExternalServices/node1/s%d", txnMaxOps))
+		})
+
+		g.It("recreate deleted keys when rolling back", func() {
+			calls := 0
+			var rollback []map[string]*kvTxnOp
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				var ops []map[string]*kvTxnOp
+				json.NewDecoder(r.Body).Decode(&ops)
+				switch calls {
+				case 1:
+					//Like consul, deletes have no result.
+					var results []map[string]*consulapi.KVPair
+					for i, op := range ops {
+						if op["KV"].Verb != "delete-cas" {
+							results = append(results, map[string]*consulapi.KVPair{"KV": {Key: op["KV"].Key, ModifyIndex: uint64(100 + i)}})
+						}
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+				case 2:
+					w.WriteHeader(http.StatusConflict)
+					fmt.Fprint(w, `{"Errors": [{"OpIndex": 0, "What": "index is stale"}]}`)
+				default:
+					rollback = ops
+					json.NewEncoder(w).Encode(map[string]interface{}{})
+				}
+			}))
+			defer server.Close()
+
+			client, _ := NewClient(&consulapi.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+			writes := []*kvWrite{{Key: "ExternalServices/node1/s0", Index: 7, Delete: true, Previous: &consulapi.KVPair{Value: []byte("old")}}}
+			for i := 1; i < txnMaxOps+1; i++ {
+				writes = append(writes, &kvWrite{Key: fmt.Sprintf("ExternalServices/node1/s%d", i), Value: []byte("{}")})
+			}
+			_, ok := writeKVAtomically(client, writes).(*TxnError)
+			g.Assert(ok).IsTrue()
+			g.Assert(len(rollback)).Equal(txnMaxOps)
+			g.Assert(*rollback[0]["KV"]).Equal(kvTxnOp{Verb: "cas", Key: "ExternalServices/node1/s0", Value: []byte("old")})
+			g.Assert(*rollback[1]["KV"]).Equal(kvTxnOp{Verb: "delete-cas", Key: "ExternalServices/node1/s1", Index: 101})
+		})
+
+		g.It("split large writes by size", func() {
+			var sizes []int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				sizes = append(sizes, len(body))
+				json.NewEncoder(w).Encode(map[string]interface{}{})
+			}))
+			defer server.Close()
+
+			client, _ := NewClient(&consulapi.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+			var writes []*kvWrite
+			for i := 0; i < 5; i++ {
+				writes = append(writes, &kvWrite{Key: fmt.Sprintf("ExternalServices/node1/s%d", i), Value: bytes.Repeat([]byte("x"), 150*1024)})
+			}
+			g.Assert(writeKVAtomically(client, writes) == nil).IsTrue()
+			g.Assert(len(sizes)).Equal(3)
+			for _, size := range sizes {
+				g.Assert(size <= txnMaxBytes).IsTrue()
+			}
+		})
+	})
+}
@@ -0,0 +1,266 @@
+package consul_externalservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Check types of an ExternalServiceDefinition.
+const (
+	CheckScript = "script"
+	CheckTTL    = "ttl"
+)
+
+//ValidationErrors lists every problem found while validating definitions.
+type ValidationErrors []string
+
+func (e ValidationErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+//ValidateName checks a node or service name can be used in the key of a
+//definition and in the name of its check.
+func ValidateName(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name is empty", kind)
+	}
+	if strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("%s name %q must not contain '/', ':' or spaces", kind, name)
+	}
+	return nil
+}
+
+//Validate checks esd and returns nil or the ValidationErrors found.
+func (esd *ExternalServiceDefinition) Validate() error {
+	var errs ValidationErrors
+	if esd.Address == "" {
+		errs = append(errs, "address is empty")
+	}
+	if esd.Port < 0 || esd.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port %d out of range 0-65535", esd.Port))
+	}
+	if d, err := time.ParseDuration(esd.Interval); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid interval %q", esd.Interval))
+	} else if d <= 0 {
+		errs = append(errs, fmt.Sprintf("interval %q must be positive", esd.Interval))
+	}
+	switch esd.TargetState {
+	case "running", "stopped", "deleted":
+	default:
+		errs = append(errs, fmt.Sprintf("invalid target state %q, must be running, stopped or deleted", esd.TargetState))
+	}
+	switch esd.CheckType {
+	case "", CheckScript:
+		if esd.Command == "" {
+			errs = append(errs, "script check without command")
+		}
+	case CheckTTL:
+	default:
+		errs = append(errs, fmt.Sprintf("invalid check type %q, must be script or ttl", esd.CheckType))
+	}
+	for _, t := range esd.Tags {
+		if strings.TrimSpace(t) == "" {
+			errs = append(errs, "empty tag")
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+//Problem is an issue found in a definitions file. Line is 0 when the
+//position is unknown.
+type Problem struct {
+	File    string
+	Line    int
+	Key     string
+	Message string
+}
+
+func (p Problem) String() string {
+	pos := p.File
+	if p.Line > 0 {
+		pos = fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	if p.Key != "" {
+		return fmt.Sprintf("%s: %s: %s", pos, p.Key, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", pos, p.Message)
+}
+
+var (
+	keyLine       = regexp.MustCompile(`^\s*(-\s+)?key:\s*(.*?)\s*$`)
+	yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+)
+
+var definitionJSONFields = []string{"Address", "Port", "Command", "State", "Interval", "TargetState", "Tags", "CheckType"}
+
+//keyLines returns the line numbers of the "key:" fields of data in order,
+//with the unquoted key they hold.
+func keyLines(data []byte) ([]int, []string) {
+	var lines []int
+	var keys []string
+	for i, l := range strings.Split(string(data), "\n") {
+		if m := keyLine.FindStringSubmatch(l); m != nil {
+			lines = append(lines, i+1)
+			keys = append(keys, strings.Trim(m[2], `"'`))
+		}
+	}
+	return lines, keys
+}
+
+//serviceLines returns the line numbers where the entries of the services
+//list of a versioned export file start.
+func serviceLines(data []byte) []int {
+	var lines []int
+	inServices := false
+	indent := -1
+	for i, l := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(l, "services:") {
+			inServices = true
+			continue
+		}
+		if l != "" && l[0] != ' ' && l[0] != '-' && l[0] != '#' {
+			inServices = false
+		}
+		m := listItemLine.FindStringSubmatch(l)
+		if !inServices || m == nil {
+			continue
+		}
+		if indent < 0 {
+			indent = len(m[1])
+		}
+		if len(m[1]) == indent {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+//parseDefinitions decodes an export file in the format of its extension and
+//checks every definition in it, returning the valid definitions and every
+//problem found.
+func parseDefinitions(fileName string, data []byte) ([]*NamedDefinition, []Problem) {
+	return parseDefinitionsFormat(fileName, data, FormatFromFileName(fileName))
+}
+
+//parseDefinitionsFormat is parseDefinitions for an export file of any version
+//in format.
+func parseDefinitionsFormat(fileName string, data []byte, format string) ([]*NamedDefinition, []Problem) {
+	kv, version, err := decodeExport(data, format)
+	if err != nil {
+		p := Problem{File: fileName, Message: err.Error()}
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			fmt.Sscan(m[1], &p.Line)
+			p.Message = m[2]
+		}
+		return nil, []Problem{p}
+	}
+
+	lines, lineKeys := keyLines(data)
+	entries := entryLines(data, format)
+	next := 0
+	lineOf := func(i int, key string) int {
+		if version >= ExportVersion {
+			if i < len(entries) {
+				return entries[i]
+			}
+			return 0
+		}
+		for j := next; j < len(lines); j++ {
+			if lineKeys[j] == key {
+				next = j + 1
+				return lines[j]
+			}
+		}
+		return 0
+	}
+
+	var defs []*NamedDefinition
+	var problems []Problem
+	seen := make(map[string]int)
+	for i, a := range kv {
+		line := lineOf(i, a.Key)
+		problem := func(msg string) {
+			problems = append(problems, Problem{File: fileName, Line: line, Key: a.Key, Message: msg})
+		}
+		node, service, ok := parseServiceKey(a.Key)
+		if !ok && version >= ExportVersion {
+			problem("node and service are required")
+			continue
+		}
+		if !ok {
+			problem("malformed key, expected ExternalServices/<node>/<service>")
+			continue
+		}
+		valid := true
+		if err := ValidateName("node", node); err != nil {
+			problem(err.Error())
+			valid = false
+		}
+		if err := ValidateName("service", service); err != nil {
+			problem(err.Error())
+			valid = false
+		}
+		if first, dup := seen[a.Key]; dup {
+			problem(fmt.Sprintf("duplicate key, first defined at line %d", first))
+			continue
+		}
+		seen[a.Key] = line
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(a.Value), &fields); err != nil {
+			problem(fmt.Sprintf("invalid JSON value: %v", err))
+			continue
+		}
+		var unknown []string
+		for f := range fields {
+			known := false
+			for _, k := range definitionJSONFields {
+				if strings.EqualFold(f, k) {
+					known = true
+				}
+			}
+			if !known {
+				unknown = append(unknown, f)
+			}
+		}
+		sort.Strings(unknown)
+		for _, f := range unknown {
+			problem(fmt.Sprintf("unknown field %q", f))
+			valid = false
+		}
+		var esd ExternalServiceDefinition
+		if err := json.Unmarshal([]byte(a.Value), &esd); err != nil {
+			problem(fmt.Sprintf("invalid value: %v", err))
+			continue
+		}
+		if err := esd.Validate(); err != nil {
+			for _, msg := range err.(ValidationErrors) {
+				problem(msg)
+			}
+			valid = false
+		}
+		if valid {
+			defs = append(defs, &NamedDefinition{Node: node, Service: service, Definition: &esd})
+		}
+	}
+	return defs, problems
+}
+
+//ValidateDefinitionsFile checks every definition of an export file without
+//contacting consul and returns all the problems found.
+func ValidateDefinitionsFile(fileName string) ([]Problem, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	_, problems := parseDefinitions(fileName, data)
+	return problems, nil
+}
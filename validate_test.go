@@ -0,0 +1,91 @@
+package consul_externalservice
+
+import (
+	. "github.com/franela/goblin"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	g := Goblin(t)
+	g.Describe("definition validation", func() {
+		g.It("accepts a valid definition", func() {
+			esd := &ExternalServiceDefinition{Address: "localhost", Port: 80, Command: "ping -c 1 localhost", Interval: "1s", TargetState: "running"}
+			g.Assert(esd.Validate() == nil).IsTrue()
+		})
+
+		g.It("accepts a ttl check without command", func() {
+			esd := &ExternalServiceDefinition{Address: "localhost", Interval: "30s", TargetState: "stopped", CheckType: CheckTTL}
+			g.Assert(esd.Validate() == nil).IsTrue()
+		})
+
+		g.It("reports every problem", func() {
+			esd := &ExternalServiceDefinition{Port: 70000, Interval: "often", TargetState: "up", Tags: []string{""}}
+			errs, ok := esd.Validate().(ValidationErrors)
+			g.Assert(ok).IsTrue()
+			g.Assert(len(errs)).Equal(6)
+		})
+
+		g.It("reports the problems of a definitions file with their line", func() {
+			data := []byte(`- key: ExternalServices/node1/web
+  value: '{"Address":"localhost","Port":80,"Command":"true","Interval":"1s","TargetState":"running"}'
+- key: ExternalServices/node1
+  value: '{}'
+- key: ExternalServices/node1/web
+  value: '{"Address":"localhost","Port":80,"Command":"true","Interval":"1s","TargetState":"running"}'
+- key: ExternalServices/node1/db
+  value: '{"Address":"localhost","Port":80,"Command":"true","Intervall":"1s","TargetState":"running"}'
+`)
+			defs, problems := parseDefinitions("services.yaml", data)
+			g.Assert(len(defs)).Equal(1)
+			g.Assert(len(problems)).Equal(4)
+			g.Assert(problems[0].Line).Equal(3)
+			g.Assert(problems[1].Line).Equal(5)
+			g.Assert(problems[2].String()).Equal(`services.yaml:7: ExternalServices/node1/db: unknown field "Intervall"`)
+			g.Assert(problems[3].Line).Equal(7)
+		})
+
+		g.It("reports the problems of a versioned definitions file with their line", func() {
+			data := []byte(`version: 2
+services:
+- node: node1
+  service: web
+  address: localhost
+  port: 80
+  command: "true"
+  interval: 1s
+  targetstate: running
+  tags:
+  - http
+- service: db
+  address: localhost
+  interval: 1s
+  targetstate: running
+- node: node1
+  service: cache
+  address: localhost
+  command: "true"
+  intervall: 1s
+  targetstate: running
+`)
+			defs, problems := parseDefinitions("services.yaml", data)
+			g.Assert(len(defs)).Equal(1)
+			g.Assert(defs[0].Definition.Tags).Equal([]string{"http"})
+			g.Assert(len(problems)).Equal(3)
+			g.Assert(problems[0].String()).Equal("services.yaml:12: ExternalServices//db: node and service are required")
+			g.Assert(problems[1].String()).Equal(`services.yaml:16: ExternalServices/node1/cache: unknown field "intervall"`)
+			g.Assert(problems[2].Line).Equal(16)
+		})
+
+		g.It("refuses export versions it does not know", func() {
+			_, problems := parseDefinitions("services.yaml", []byte("version: 3\nservices: []\n"))
+			g.Assert(len(problems)).Equal(1)
+		})
+
+		g.It("rejects names that break keys or check names", func() {
+			g.Assert(ValidateName("service", "web") == nil).IsTrue()
+			g.Assert(ValidateName("service", "a:b") != nil).IsTrue()
+			g.Assert(ValidateName("node", "a/b") != nil).IsTrue()
+			g.Assert(ValidateName("node", "") != nil).IsTrue()
+		})
+	})
+}